@@ -2,6 +2,8 @@ package app
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
@@ -14,6 +16,30 @@ const (
 	slug       = "bthompso/apl-demo-infra/dev"
 )
 
+// aplK8sVersions are the kubernetes minor versions the pinned apl chart supports,
+// and are updated together with aplVersion
+var aplK8sVersions = []string{"1.31", "1.32", "1.33"}
+
+// ChartVersion is the pinned apl chart version
+func ChartVersion() string {
+	return aplVersion
+}
+
+// K8sVersions are the kubernetes versions the pinned apl chart supports
+func K8sVersions() []string {
+	return slices.Clone(aplK8sVersions)
+}
+
+// SupportsK8s reports whether the pinned apl chart supports a kubernetes version, by minor version
+func SupportsK8s(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+
+	return slices.Contains(aplK8sVersions, parts[0]+"."+parts[1])
+}
+
 type StackRef struct {
 	Stack *pulumi.StackReference
 }
@@ -65,6 +91,7 @@ type AplResourceInfo struct {
 	Resources map[string]interface{}
 	Token     string
 	Apl       map[string]string
+	Overlays  []string
 }
 
 func (r *AplResourceInfo) Run(ctx *pulumi.Context) error {
@@ -87,29 +114,38 @@ func run(ctx *pulumi.Context, r *AplResourceInfo) error {
 	label := st.Details("aplDemoLabel").Value.(string)
 	nbId := st.Details("loadbalancerId").Value.(string)
 	nbTag := st.Details("loadbalancerTag").Value.(string)
+	nbThrottle, nbManaged := "20", false
+	if d := st.Details("loadbalancerThrottle"); d != nil && d.Value != nil {
+		nbThrottle = d.Value.(string)
+	}
+	if d := st.Details("loadbalancerManaged"); d != nil && d.Value != nil {
+		nbManaged = d.Value.(bool)
+	}
 	obj := st.Details("obj").SecretValue.(map[string]interface{})
 	objBuckets := st.Details("objBuckets").Value.([]interface{})
 	subs := st.Details("subdomains").Value.(map[string]interface{})
 
 	objRegion := fmt.Sprintf("%v-1", region)
 	override := map[string]any{
-		"region":             objRegion,
-		"domain":             dn,
-		"token":              r.Token,
-		"accessKey":          obj["accessKey"],
-		"secretKey":          obj["secretKey"],
-		"prefix":             obj["objPrefix"],
-		"buckets":            objBuckets,
-		"nodebalancerId":     nbId,
-		"nodebalancerIpv4":   ipv4,
-		"nodebalancerTag":    nbTag,
-		"ageKey":             r.Apl["ageKey"],
-		"agePrivKey":         r.Apl["agePrivKey"],
-		"lokiAdmin":          r.Apl["lokiAdmin"],
-		"otomiAdmin":         r.Apl["otomiAdmin"],
-		"teamDevelop":        r.Apl["teamDevelop"],
-		"platformAdminEmail": r.Apl["email"],
-		"platformLabel":      r.Apl["label"],
+		"region":               objRegion,
+		"domain":               dn,
+		"token":                r.Token,
+		"accessKey":            obj["accessKey"],
+		"secretKey":            obj["secretKey"],
+		"prefix":               obj["objPrefix"],
+		"buckets":              objBuckets,
+		"nodebalancerId":       nbId,
+		"nodebalancerIpv4":     ipv4,
+		"nodebalancerTag":      nbTag,
+		"nodebalancerThrottle": nbThrottle,
+		"nodebalancerManaged":  nbManaged,
+		"ageKey":               r.Apl["ageKey"],
+		"agePrivKey":           r.Apl["agePrivKey"],
+		"lokiAdmin":            r.Apl["lokiAdmin"],
+		"otomiAdmin":           r.Apl["otomiAdmin"],
+		"teamDevelop":          r.Apl["teamDevelop"],
+		"platformAdminEmail":   r.Apl["email"],
+		"platformLabel":        r.Apl["label"],
 	}
 
 	k, err := utils.DecodeKubeConfig(label, kubecfg, true)
@@ -168,6 +204,7 @@ func run(ctx *pulumi.Context, r *AplResourceInfo) error {
 		ReuseValues:     true,
 		Timeout:         1200,
 		ValuesFile:      values,
+		ValuesOverlays:  r.Overlays,
 		Version:         aplVersion,
 		WaitForJobs:     false,
 	}
@@ -31,6 +31,7 @@ type HelmOptions struct {
 	ReuseValues     bool
 	Timeout         int
 	ValuesFile      string
+	ValuesOverlays  []string
 	ValuesOverride  pulumi.Map
 	Verify          bool
 	Version         string
@@ -55,6 +56,15 @@ func NewKubePkg(ctx *pulumi.Context, pkg string, args *KubePkgArgs, opts ...pulu
 		chartName = helmOpts.Chart
 	}
 
+	// later values files take precedence, so overlays go after the values file
+	valueFiles := pulumi.AssetOrArchiveArray{
+		pulumi.NewStringAsset(helmOpts.ValuesFile),
+		// pulumi.NewFileAsset(helmOpts.ValuesFile),
+	}
+	for _, v := range helmOpts.ValuesOverlays {
+		valueFiles = append(valueFiles, pulumi.NewStringAsset(v))
+	}
+
 	_, err = helm.NewRelease(ctx, helmOpts.Chart, &helm.ReleaseArgs{
 		Chart:           pulumi.String(helmOpts.Chart),
 		CreateNamespace: pulumi.Bool(helmOpts.CreateNamespace),
@@ -66,16 +76,13 @@ func NewKubePkg(ctx *pulumi.Context, pkg string, args *KubePkgArgs, opts ...pulu
 		RepositoryOpts: helm.RepositoryOptsArgs{
 			Repo: pulumi.String(helmOpts.Repo),
 		},
-		ReuseValues: pulumi.Bool(helmOpts.ReuseValues),
-		Timeout:     pulumi.Int(helmOpts.Timeout),
-		ValueYamlFiles: pulumi.AssetOrArchiveArray{
-			pulumi.NewStringAsset(helmOpts.ValuesFile),
-			// pulumi.NewFileAsset(helmOpts.ValuesFile),
-		},
-		Values:      helmOpts.ValuesOverride,
-		Verify:      pulumi.Bool(helmOpts.Verify),
-		Version:     pulumi.String(helmOpts.Version),
-		WaitForJobs: pulumi.Bool(helmOpts.WaitForJobs),
+		ReuseValues:    pulumi.Bool(helmOpts.ReuseValues),
+		Timeout:        pulumi.Int(helmOpts.Timeout),
+		ValueYamlFiles: valueFiles,
+		Values:         helmOpts.ValuesOverride,
+		Verify:         pulumi.Bool(helmOpts.Verify),
+		Version:        pulumi.String(helmOpts.Version),
+		WaitForJobs:    pulumi.Bool(helmOpts.WaitForJobs),
 	}, pulumi.Provider(provider), pulumi.IgnoreChanges([]string{"checksum"}), pulumi.Parent(&kubePkgResource))
 	if err != nil {
 		return nil, err
@@ -28,6 +28,10 @@ apps:
             external-dns.alpha.kubernetes.io/ttl: '30'
             service.beta.kubernetes.io/linode-loadbalancer-tags: '{{ .nodebalancerTag }}'
             service.beta.kubernetes.io/linode-loadbalancer-nodebalancer-id: '{{ .nodebalancerId }}'
+            service.beta.kubernetes.io/linode-loadbalancer-throttle: '{{ .nodebalancerThrottle }}'
+            {{- if .nodebalancerManaged }}
+            service.beta.kubernetes.io/linode-loadbalancer-preserve: 'true'
+            {{- end }}
   jaeger:
     enabled: true
   harbor:
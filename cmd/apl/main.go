@@ -23,9 +23,14 @@ func main() {
 			"agePrivKey":  aplcfg.Require("agePrivateKey"),
 			"lokiAdmin":   aplcfg.Require("lokiAdminPassword"),
 		}
+		// optional helm values overlays, applied on top of the apl-values template
+		var overlays []string
+		_ = aplcfg.TryObject("valuesOverlays", &overlays)
+
 		apl := app.AplResourceInfo{
-			Token: cfg.Require("token"),
-			Apl:   aplVars,
+			Token:    cfg.Require("token"),
+			Apl:      aplVars,
+			Overlays: overlays,
 		}
 		err := apl.Run(ctx)
 		if err != nil {
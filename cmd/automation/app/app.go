@@ -3,13 +3,16 @@ package app
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	utils "github.com/rylabs-billy/steal-this-idp/utils"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
@@ -29,6 +32,9 @@ type microStack struct {
 
 type stackMap map[string]microStack
 
+// microStacks deploy in this order, and are destroyed in reverse
+var deployOrder = []string{"infra", "apl"}
+
 func (colorUp) ApplyOption(opts *optup.Options) {
 	opts.Color = "always"
 }
@@ -54,6 +60,21 @@ const (
 	Reset   = "\033[0m"
 )
 
+var (
+	// stdout receives the info messages, so a dashboard can take over the terminal
+	stdout io.Writer = os.Stdout
+
+	// onExit funcs run in reverse order before the program exits, e.g. to restore the terminal
+	onExit []func(code int)
+)
+
+func exit(code int) {
+	for i := len(onExit) - 1; i >= 0; i-- {
+		onExit[i](code)
+	}
+	os.Exit(code)
+}
+
 func Run() {
 	ctx := context.Background()
 
@@ -86,16 +107,15 @@ func Run() {
 	cmd.Doit(ctx)
 }
 
-func initLocalStack(ctx context.Context, stk microStack) auto.Stack {
-	dir := stk.name
-	fqsn := stk.fqsn
+// stackDir is the workspace of a microStack, relative to the binary working dir
+func stackDir(stk microStack) string {
+	return filepath.Join("..", stk.name, "app")
+}
 
-	ws := filepath.Join("..", dir, "app")
-	s, err := auto.UpsertStackLocalSource(ctx, fqsn, ws)
+func localStack(ctx context.Context, stk microStack) (auto.Stack, error) {
+	s, err := auto.UpsertStackLocalSource(ctx, stk.fqsn, stackDir(stk))
 	if err != nil {
-		fmt.Printf("\n%s%-10s %s failed to get local stack: %s %s\n", Red, "[error]", Grey, fqsn, Reset)
-		fmt.Printf("%s%-10s %v %s\n", Grey, "", err, Reset)
-		os.Exit(1)
+		return s, err
 	}
 
 	if utils.AssertResource(stk.buildFn) {
@@ -106,10 +126,98 @@ func initLocalStack(ctx context.Context, stk microStack) auto.Stack {
 		s.Workspace().SetProgram(stk.configFn)
 	}
 
-	fmt.Printf("\n%s%-10s %s using stack: %s %s\n", Green, "[info]", Grey, fqsn, Reset)
+	return s, nil
+}
+
+func initLocalStack(ctx context.Context, stk microStack) auto.Stack {
+	fqsn := stk.fqsn
+
+	s, err := localStack(ctx, stk)
+	if err != nil {
+		fmt.Fprintf(stdout, "\n%s%-10s %s failed to get local stack: %s %s\n", Red, "[error]", Grey, fqsn, Reset)
+		fmt.Fprintf(stdout, "%s%-10s %v %s\n", Grey, "", err, Reset)
+		exit(1)
+	}
+
+	fmt.Fprintf(stdout, "\n%s%-10s %s using stack: %s %s\n", Green, "[info]", Grey, fqsn, Reset)
 	return s
 }
 
+// stackUp deploys a stack, and keeps the infra nodebalancer id in config for the next run
+func stackUp(ctx context.Context, s auto.Stack, stk microStack, opts ...optup.Option) (auto.UpResult, error) {
+	// without a nodebalancer-id, the infra stack deploys a placeholder service for it
+	var placeholder bool
+	if stk.name == "infra" {
+		_, err := s.GetConfig(ctx, managedConfig)
+		placeholder = err != nil
+	}
+
+	res, err := s.Up(ctx, opts...)
+	if err != nil {
+		return res, err
+	}
+
+	if stk.name != "infra" {
+		return res, nil
+	}
+	nbid, _ := res.Outputs["loadbalancerId"].Value.(string)
+	if nbid == "" {
+		return res, nil
+	}
+	if err := s.SetConfig(ctx, managedConfig, auto.ConfigValue{Value: nbid}); err != nil {
+		return res, err
+	}
+
+	// hand the nodebalancer over to the ingress of the apl stack: with the id in config, the
+	// placeholder service is deleted, and the preserve annotation keeps the nodebalancer. The
+	// event streams of the first up are closed, so this one runs without them
+	managed, _ := res.Outputs["loadbalancerManaged"].Value.(bool)
+	if placeholder && !managed {
+		fmt.Fprintf(stdout, "\n%s%-10s %s releasing the placeholder service of nodebalancer %s %s\n", Green, "[info]", Grey, nbid, Reset)
+		return s.Up(ctx, colorUp{})
+	}
+
+	return res, nil
+}
+
+// refreshStack updates the stack state before an operation, errors are left to the operation itself
+func refreshStack(ctx context.Context, s auto.Stack, stk microStack) {
+	ctx, span := stackSpan(ctx, "refresh", stk)
+
+	var opts []optrefresh.Option
+	if tracing {
+		opts = append(opts, optrefresh.EventStreams(traceEvents(ctx, stk)))
+	}
+
+	_, err := s.Refresh(ctx, opts...)
+	endSpan(span, err)
+}
+
+func stackDown(ctx context.Context, s auto.Stack, stk microStack, opts ...optdestroy.Option) error {
+	_, err := s.Destroy(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	if stk.name == "infra" {
+		s.RemoveConfig(ctx, managedConfig)
+	}
+
+	return nil
+}
+
+// platform returns the microStacks of another platform, in stacks named by its label
+func (m stackMap) platform(label string) stackMap {
+	stks := stackMap{}
+	for k, stk := range m {
+		i := strings.LastIndex(stk.fqsn, "/")
+		stk.fqsn = stk.fqsn[:i+1] + label
+		stks[k] = stk
+	}
+
+	return stks
+}
+
 func msg(opt, stk string, err error) {
 	var (
 		cols1 = "\n%s%-10s %s stack %s: %s %s\n"
@@ -118,18 +226,18 @@ func msg(opt, stk string, err error) {
 		cols4 = "\n%s%-10s %s %s stack: %s %s\n"
 	)
 	switch opt {
-	case "deploy", "destroy":
+	case "deploy", "destroy", "upgrade":
 		if err == nil {
-			fmt.Printf(cols1, Green, "[info]", Grey, opt, stk, Reset)
+			fmt.Fprintf(stdout, cols1, Green, "[info]", Grey, opt, stk, Reset)
 		} else {
-			fmt.Printf(cols2, Red, "[error]", Grey, opt, stk, Reset)
-			fmt.Printf(cols3, Red, "[error]", Grey, err, Reset)
-			os.Exit(1)
+			fmt.Fprintf(stdout, cols2, Red, "[error]", Grey, opt, stk, Reset)
+			fmt.Fprintf(stdout, cols3, Red, "[error]", Grey, err, Reset)
+			exit(1)
 		}
 	case "deploying", "destroying":
-		fmt.Printf(cols4, Green, "[info]", Grey, opt, stk, Reset)
+		fmt.Fprintf(stdout, cols4, Green, "[info]", Grey, opt, stk, Reset)
 	case "invalid":
-		fmt.Printf(cols3, Red, "[error]", Grey, err, Reset)
-		os.Exit(1)
+		fmt.Fprintf(stdout, cols3, Red, "[error]", Grey, err, Reset)
+		exit(1)
 	}
 }
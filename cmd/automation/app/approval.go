@@ -0,0 +1,509 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// approvalsConfig is keyed by environment like the change policy, e.g.
+// {"production": {"required": 2, "approvers": {"alice": "ssh-ed25519 AAAA..."}}}
+const (
+	approvalsConfig    = "apl:approvals"
+	approvalsFile      = "approvals.yaml"
+	approvalNamespace  = "aplcli"
+	sshSignatureMagic  = "SSHSIG"
+	sshSignatureHeader = "SSH SIGNATURE"
+)
+
+// policyConfig protects a stack, so a change to it needs approvals like any other change
+var policyConfig = []string{environmentConfig, approvalsConfig}
+
+// policyChange sets or removes a policy key, from the value it has now
+type policyChange struct {
+	key, from, to string
+	remove        bool
+}
+
+// approvalPolicy is the number of approvers an environment requires, and their public keys
+type approvalPolicy struct {
+	Required  int               `json:"required"`
+	Approvers map[string]string `json:"approvers"`
+}
+
+// approval is one signature over the preview hash of a stack
+type approval struct {
+	Stack     string `yaml:"stack"`
+	Op        string `yaml:"op"`
+	Hash      string `yaml:"hash"`
+	Approver  string `yaml:"approver"`
+	Signature string `yaml:"signature"`
+}
+
+type approvals struct {
+	Approvals []approval `yaml:"approvals"`
+}
+
+// readApprovalPolicy returns the policy of the environment of a stack, or nil when it requires none
+func readApprovalPolicy(cfg auto.ConfigMap) (*approvalPolicy, error) {
+	env := cfg[environmentConfig].Value
+	v := cfg[approvalsConfig].Value
+	if env == "" || v == "" {
+		return nil, nil
+	}
+
+	var policies map[string]approvalPolicy
+	if err := json.Unmarshal([]byte(v), &policies); err != nil {
+		return nil, fmt.Errorf("%s is not a map of environments to approvers: %w", approvalsConfig, err)
+	}
+	p, ok := policies[env]
+	if !ok || p.Required == 0 {
+		return nil, nil
+	}
+
+	return &p, p.valid()
+}
+
+func (p approvalPolicy) valid() error {
+	if p.Required > len(p.Approvers) {
+		return fmt.Errorf("%s requires %d approvals from %d approvers", approvalsConfig, p.Required, len(p.Approvers))
+	}
+	for name, key := range p.Approvers {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			return fmt.Errorf("%s: public key of %s: %w", approvalsConfig, name, err)
+		}
+	}
+
+	return nil
+}
+
+// validApprovals checks the approvers when they are set with aplcli config
+func validApprovals(key, value string) error {
+	if key != approvalsConfig {
+		return nil
+	}
+
+	var policies map[string]approvalPolicy
+	if err := json.Unmarshal([]byte(value), &policies); err != nil {
+		return fmt.Errorf("%s is not a map of environments to approvers: %w", key, err)
+	}
+	for _, p := range policies {
+		if err := p.valid(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// previewHash previews a create or destroy, and hashes the steps that change something together
+// with a fingerprint of the stack config, so any change to either needs a new approval
+func previewHash(ctx context.Context, s auto.Stack, stk microStack, op string) (string, error) {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	project, err := s.Workspace().ProjectSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ch := make(chan events.EngineEvent)
+	done := make(chan []string)
+	go func() {
+		var steps []string
+		for e := range ch {
+			if e.ResourcePreEvent == nil {
+				continue
+			}
+			md := e.ResourcePreEvent.Metadata
+			if md.Op == apitype.OpSame {
+				continue
+			}
+			diffs := slices.Clone(md.Diffs)
+			sort.Strings(diffs)
+			steps = append(steps, fmt.Sprintf("%s %s %s", md.Op, md.URN, strings.Join(diffs, ",")))
+		}
+		done <- steps
+	}()
+
+	switch op {
+	case "destroy":
+		_, err = s.PreviewDestroy(ctx, optdestroy.EventStreams(ch))
+	default:
+		_, err = s.Preview(ctx, optpreview.EventStreams(ch))
+	}
+	steps := <-done
+	if err != nil {
+		return "", fmt.Errorf("failed to preview stack %s: %w", stk.fqsn, err)
+	}
+	sort.Strings(steps)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s preview v1\nstack %s\nop %s\n", prog, stk.fqsn, op)
+	for _, k := range approvedConfig(cfg, string(project.Name)) {
+		fmt.Fprintf(h, "config %s %q\n", k, cfg[k].Value)
+	}
+	for _, step := range steps {
+		fmt.Fprintf(h, "step %s\n", step)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// approvedConfig returns the sorted config keys that an approval covers. The managed
+// nodebalancer id follows from an up, and is not something to approve. Like every key
+// without a namespace, it is in the namespace of the project
+func approvedConfig(cfg auto.ConfigMap, project string) []string {
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		if k != project+":"+managedConfig {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func readApprovals(file string) (approvals, error) {
+	var a approvals
+
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+
+	return a, yaml.Unmarshal(b, &a)
+}
+
+func (a approvals) write(file string) error {
+	b, err := yaml.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, b, 0o644)
+}
+
+// verifySignature checks an armored ssh signature (ssh-keygen -Y sign -n aplcli) over the hash
+func verifySignature(pubKey, armored, msg string) error {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(armored))
+	if block == nil || block.Type != sshSignatureHeader {
+		return fmt.Errorf("not an armored ssh signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte(sshSignatureMagic))
+	if !ok {
+		return fmt.Errorf("not an ssh signature")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return fmt.Errorf("invalid ssh signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported ssh signature version %d", sig.Version)
+	}
+	if sig.Namespace != approvalNamespace {
+		return fmt.Errorf("signature is for namespace %q, not %q", sig.Namespace, approvalNamespace)
+	}
+	if !bytes.Equal(sig.PublicKey, key.Marshal()) {
+		return fmt.Errorf("signature is made with another key")
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported signature hash %q", sig.HashAlgorithm)
+	}
+	h.Write([]byte(msg))
+
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return fmt.Errorf("invalid ssh signature: %w", err)
+	}
+
+	signed := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+
+	return key.Verify(signed, &s)
+}
+
+// checkApprovals refuses a change to a protected environment, unless enough approvers
+// signed the exact preview hash of the change
+func checkApprovals(ctx context.Context, s auto.Stack, stk microStack, op, file string) error {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return err
+	}
+	p, err := readApprovalPolicy(cfg)
+	if err != nil || p == nil {
+		return err
+	}
+
+	digest, err := previewHash(ctx, s, stk, op)
+	if err != nil {
+		return err
+	}
+
+	return verifyApprovals(p, stk, op, digest, file)
+}
+
+// hash covers the stack, the key and both values, so an approval is for this change only
+func (c policyChange) hash(stk microStack) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s policy v1\nstack %s\nkey %s\nfrom %q\n", prog, stk.fqsn, c.key, c.from)
+	if c.remove {
+		fmt.Fprintf(h, "remove\n")
+	} else {
+		fmt.Fprintf(h, "to %q\n", c.to)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readPolicyChange fills in the current value of the key, and returns the policy of the stack
+// as it is now, or nil when the stack isn't protected or the change changes nothing
+func readPolicyChange(ctx context.Context, s auto.Stack, c *policyChange) (*approvalPolicy, error) {
+	if !slices.Contains(policyConfig, c.key) {
+		return nil, nil
+	}
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := cfg[c.key]
+	if (c.remove && !ok) || (!c.remove && ok && v.Value == c.to) {
+		return nil, nil
+	}
+	c.from = v.Value
+
+	return readApprovalPolicy(cfg)
+}
+
+// checkPolicyChange refuses to change the environment or approvers of a protected stack,
+// unless enough of its current approvers signed the change
+func checkPolicyChange(ctx context.Context, s auto.Stack, stk microStack, c policyChange, file string) error {
+	p, err := readPolicyChange(ctx, s, &c)
+	if err != nil || p == nil {
+		return err
+	}
+
+	return verifyApprovals(p, stk, "config", c.hash(stk), file)
+}
+
+// verifyApprovals counts the valid signatures over the digest in the approvals file
+func verifyApprovals(p *approvalPolicy, stk microStack, op, digest, file string) error {
+	a, err := readApprovals(file)
+	if err != nil {
+		return fmt.Errorf("failed to read approvals %s: %w", file, err)
+	}
+
+	var approved []string
+	for _, ap := range a.Approvals {
+		key, ok := p.Approvers[ap.Approver]
+		if ap.Stack != stk.fqsn || ap.Hash != digest || !ok || slices.Contains(approved, ap.Approver) {
+			continue
+		}
+		if err := verifySignature(key, ap.Signature, digest); err != nil {
+			fmt.Fprintf(stdout, "\n%s%-10s %s ignoring approval of %s: %v %s\n", Red, "[warn]", Grey, ap.Approver, err, Reset)
+			continue
+		}
+		approved = append(approved, ap.Approver)
+	}
+
+	if len(approved) >= p.Required {
+		fmt.Fprintf(stdout, "\n%s%-10s %s %s of %s approved by %s %s\n", Green, "[approve]", Grey, op, stk.fqsn, strings.Join(approved, ", "), Reset)
+		return nil
+	}
+
+	var missing []string
+	for name := range p.Approvers {
+		if !slices.Contains(approved, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	return fmt.Errorf("refusing to %s %s, %d of %d approvals over hash %s, still needs %d more from %s, see %s approve",
+		op, stk.fqsn, len(approved), p.Required, digest, p.Required-len(approved), strings.Join(missing, ", "), prog)
+}
+
+// approve prints the preview hash of a stack, and adds a signature over it to the approvals file
+func approve(ctx context.Context, cmd *clicmd) {
+	stk, ok := cmd.stacks[cmd.target]
+	if !ok {
+		msg("invalid", "", fmt.Errorf("approve requires --stack, one of %s", strings.Join(cmd.stacks.stackNames(), ", ")))
+	}
+	if cmd.policySet != "" || cmd.policyUnset != "" {
+		cmd.op = "config"
+	}
+	if cmd.op != "create" && cmd.op != "destroy" && cmd.op != "config" {
+		msg("invalid", "", fmt.Errorf("unknown op %q, expected create, destroy or config", cmd.op))
+	}
+	if cmd.version != "" && (stk.name != "infra" || cmd.op != "create") {
+		msg("invalid", "", fmt.Errorf("--version approves an upgrade, which is a create of the infra stack"))
+	}
+
+	s := initLocalStack(ctx, stk)
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	p, err := readApprovalPolicy(cfg)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	var digest string
+	switch cmd.op {
+	case "config":
+		// a change to the policy is approved by the approvers it has now
+		c, err := approvedPolicyChange(cmd)
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		if p, err = readPolicyChange(ctx, s, &c); err != nil {
+			msg("invalid", "", err)
+		}
+		digest = c.hash(stk)
+		fmt.Fprintf(stdout, "\n%s%-10s %s hash of changing %s of %s: %s %s\n", Green, "[approve]", Grey, c.key, stk.fqsn, digest, Reset)
+	default:
+		// an upgrade is approved over a preview with its version, which is set for the preview only
+		restore := func() error { return nil }
+		if cmd.version != "" {
+			if restore, err = setK8sVersion(ctx, s, cmd.version); err != nil {
+				msg("invalid", "", err)
+			}
+		}
+		refreshStack(ctx, s, stk)
+		digest, err = previewHash(ctx, s, stk, cmd.op)
+		if rerr := restore(); rerr != nil && err == nil {
+			err = fmt.Errorf("failed to restore %s: %w", k8sVersionConfig, rerr)
+		}
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		fmt.Fprintf(stdout, "\n%s%-10s %s preview hash of %s %s: %s %s\n", Green, "[approve]", Grey, cmd.op, stk.fqsn, digest, Reset)
+	}
+	if p == nil {
+		fmt.Fprintf(stdout, "\n%s%-10s %s the environment of %s requires no approvals %s\n", Red, "[warn]", Grey, stk.fqsn, Reset)
+	}
+
+	var sig string
+	switch {
+	case cmd.signingKey != "":
+		c := exec.CommandContext(ctx, "ssh-keygen", "-Y", "sign", "-n", approvalNamespace, "-f", cmd.signingKey)
+		c.Stdin = strings.NewReader(digest)
+		c.Stderr = os.Stderr
+		out, err := c.Output()
+		if err != nil {
+			msg("invalid", "", fmt.Errorf("ssh-keygen failed to sign: %w", err))
+		}
+		sig = string(out)
+	case cmd.signatureFile != "":
+		b, err := os.ReadFile(cmd.signatureFile)
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		sig = string(b)
+	default:
+		fmt.Fprintf(stdout, "\n%s%-10s %s sign with: printf %%s %s | ssh-keygen -Y sign -n %s -f <key> %s\n", Green, "[info]", Grey, digest, approvalNamespace, Reset)
+		exit(0)
+	}
+
+	// signatures that don't verify are refused here, rather than ignored at deploy time
+	if p != nil {
+		key, ok := p.Approvers[cmd.approver]
+		if !ok {
+			msg("invalid", "", fmt.Errorf("%q is not an approver of %s, see %s", cmd.approver, stk.fqsn, approvalsConfig))
+		}
+		if err := verifySignature(key, sig, digest); err != nil {
+			msg("invalid", "", fmt.Errorf("signature of %s does not verify: %w", cmd.approver, err))
+		}
+	}
+
+	a, err := readApprovals(cmd.approvals)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	a.Approvals = append(a.Approvals, approval{
+		Stack:     stk.fqsn,
+		Op:        cmd.op,
+		Hash:      digest,
+		Approver:  cmd.approver,
+		Signature: sig,
+	})
+	if err := a.write(cmd.approvals); err != nil {
+		msg("invalid", "", err)
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s added approval of %s to %s %s\n", Green, "[approve]", Grey, cmd.approver, cmd.approvals, Reset)
+	exit(0)
+}
+
+// approvedPolicyChange is the change of --set key=value or --unset key
+func approvedPolicyChange(cmd *clicmd) (policyChange, error) {
+	var c policyChange
+	switch {
+	case cmd.policySet != "" && cmd.policyUnset != "":
+		return c, fmt.Errorf("approve either --set or --unset")
+	case cmd.policySet != "":
+		k, v, ok := strings.Cut(cmd.policySet, "=")
+		if !ok {
+			return c, fmt.Errorf("--set %q is not key=value", cmd.policySet)
+		}
+		c.key, c.to = configKey(k), v
+	case cmd.policyUnset != "":
+		c.key, c.remove = configKey(cmd.policyUnset), true
+	default:
+		return c, fmt.Errorf("--op config requires --set key=value or --unset key")
+	}
+	if !slices.Contains(policyConfig, c.key) {
+		return c, fmt.Errorf("%s needs no approval, only %s do", c.key, strings.Join(policyConfig, " and "))
+	}
+
+	return c, nil
+}
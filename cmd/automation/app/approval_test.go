@@ -0,0 +1,152 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedKey(signer ssh.Signer) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+// sshSign signs like ssh-keygen -Y sign -n <namespace>
+func sshSign(t *testing.T, signer ssh.Signer, namespace, msg string) string {
+	t.Helper()
+	h := sha512.Sum512([]byte(msg))
+	signed := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, nil, "sha512", h[:]})...)
+
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), namespace, nil, "sha512", ssh.Marshal(sig)})...)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: sshSignatureHeader, Bytes: blob}))
+}
+
+const (
+	testDigest      = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	staleTestDigest = "1f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+)
+
+func TestVerifySignature(t *testing.T) {
+	alice, mallory := newSigner(t), newSigner(t)
+
+	tests := []struct {
+		name      string
+		signature string
+		valid     bool
+	}{
+		{"valid", sshSign(t, alice, approvalNamespace, testDigest), true},
+		{"another key", sshSign(t, mallory, approvalNamespace, testDigest), false},
+		{"another namespace", sshSign(t, alice, "git", testDigest), false},
+		{"stale testDigest", sshSign(t, alice, approvalNamespace, staleTestDigest), false},
+		{"not armored", "AAAA", false},
+	}
+	for _, tt := range tests {
+		err := verifySignature(authorizedKey(alice), tt.signature, testDigest)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("%s: got %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestVerifyApprovals(t *testing.T) {
+	alice, bob, carol := newSigner(t), newSigner(t), newSigner(t)
+	p := &approvalPolicy{Required: 2, Approvers: map[string]string{
+		"alice": authorizedKey(alice),
+		"bob":   authorizedKey(bob),
+		"carol": authorizedKey(carol),
+	}}
+	stk := microStack{name: "infra", fqsn: "org/infra/prod"}
+	approve := func(name string, signer ssh.Signer, stack, hash string) approval {
+		return approval{Stack: stack, Op: "create", Hash: hash, Approver: name, Signature: sshSign(t, signer, approvalNamespace, hash)}
+	}
+
+	tests := []struct {
+		name      string
+		approvals []approval
+		approved  bool
+	}{
+		{"two approvers", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("bob", bob, stk.fqsn, testDigest),
+		}, true},
+		{"one approver twice", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("alice", alice, stk.fqsn, testDigest),
+		}, false},
+		{"a stale testDigest", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("bob", bob, stk.fqsn, staleTestDigest),
+		}, false},
+		{"another stack", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("bob", bob, "org/infra/staging", testDigest),
+		}, false},
+		{"signed with another key", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("bob", carol, stk.fqsn, testDigest),
+		}, false},
+		{"not an approver", []approval{
+			approve("alice", alice, stk.fqsn, testDigest),
+			approve("mallory", newSigner(t), stk.fqsn, testDigest),
+		}, false},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), approvalsFile)
+		if err := (approvals{Approvals: tt.approvals}).write(file); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyApprovals(p, stk, "create", testDigest, file)
+		if approved := err == nil; approved != tt.approved {
+			t.Errorf("%s: got %v, want approved %t", tt.name, err, tt.approved)
+		}
+	}
+}
+
+func TestApprovedConfig(t *testing.T) {
+	cfg := auto.ConfigMap{
+		"apl:label":             {Value: "apl-demo"},
+		"infra:nodebalancer-id": {Value: "7"},
+		"linode:token":          {Value: "secret", Secret: true},
+	}
+	got := approvedConfig(cfg, "infra")
+	if want := []string{"apl:label", "linode:token"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %v, want %v without the managed nodebalancer id", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// managedConfig is kept in stack config by aplcli itself, see stackUp
+const managedConfig = "nodebalancer-id"
+
+// structured config of the infra stack, validated by the infra program's parsers
+const (
+	nodePoolsConfig       = "apl:nodePools"
+	controlPlaneAclConfig = "apl:controlPlaneAcl"
+	firewallRulesConfig   = "apl:firewallRules"
+	vpcConfig             = "apl:vpc"
+	k8sVersionConfig      = "apl:k8sVersion"
+	nodebalancerConfig    = "apl:nodebalancer"
+	lookupTimeoutConfig   = "apl:nodebalancerLookupTimeout"
+	lookupBackoffConfig   = "apl:nodebalancerLookupBackoff"
+)
+
+// optional config keys, read by the programs with Try or by aplcli itself
+var optionalConfig = map[string][]string{
+	"infra": {
+		nodePoolsConfig,
+		controlPlaneAclConfig,
+		firewallRulesConfig,
+		vpcConfig,
+		k8sVersionConfig,
+		nodebalancerConfig,
+		lookupTimeoutConfig,
+		lookupBackoffConfig,
+		"linode:url",
+		"linode:apiVersion",
+		budgetConfig,
+		environmentConfig,
+		windowsConfig,
+		freezesConfig,
+		approvalsConfig,
+	},
+	"apl": {
+		"apl:valuesOverlays",
+		environmentConfig,
+		windowsConfig,
+		freezesConfig,
+		approvalsConfig,
+	},
+}
+
+// secretConfig is always stored encrypted, with or without --secret
+var secretConfig = []string{
+	"linode:token",
+	"apl:otomiAdminPassword",
+	"apl:teamDevelopPassword",
+	"apl:lokiAdminPassword",
+	"apl:agePrivateKey",
+}
+
+func configCmd(ctx context.Context, cmd *clicmd) {
+	stk, ok := cmd.stacks[cmd.target]
+	if !ok {
+		msg("invalid", "", fmt.Errorf("config requires --stack, one of %s", strings.Join(cmd.stacks.stackNames(), ", ")))
+	}
+
+	var key string
+	if len(cmd.args) > 0 {
+		key = configKey(cmd.args[0])
+		if err := validConfigKey(stk, key, cmd.op); err != nil {
+			msg("invalid", "", err)
+		}
+	}
+
+	s, err := auto.SelectStackLocalSource(ctx, stk.fqsn, stackDir(stk))
+	if err != nil {
+		msg("invalid", "", fmt.Errorf("failed to select stack %s: %w", stk.fqsn, err))
+	}
+
+	switch cmd.op {
+	case "get":
+		v, err := s.GetConfig(ctx, key)
+		if err != nil {
+			msg("invalid", "", fmt.Errorf("%s is not set in stack %s", key, stk.fqsn))
+		}
+		fmt.Println(v.Value)
+	case "set":
+		if err := validChangePolicy(key, cmd.args[1]); err != nil {
+			msg("invalid", "", err)
+		}
+		if err := validApprovals(key, cmd.args[1]); err != nil {
+			msg("invalid", "", err)
+		}
+		if err := validInfraConfig(key, cmd.args[1]); err != nil {
+			msg("invalid", "", err)
+		}
+		// the policy of a protected stack only changes as its approvers signed
+		change := policyChange{key: key, to: cmd.args[1]}
+		if err := checkPolicyChange(ctx, s, stk, change, cmd.approvals); err != nil {
+			msg("invalid", "", err)
+		}
+		secret := cmd.secret || slices.Contains(secretConfig, key)
+		err = s.SetConfig(ctx, key, auto.ConfigValue{Value: cmd.args[1], Secret: secret})
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		fmt.Fprintf(stdout, "\n%s%-10s %s set %s in stack %s %s\n", Green, "[info]", Grey, key, stk.fqsn, Reset)
+	case "rm":
+		change := policyChange{key: key, remove: true}
+		if err := checkPolicyChange(ctx, s, stk, change, cmd.approvals); err != nil {
+			msg("invalid", "", err)
+		}
+		err = s.RemoveConfig(ctx, key)
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		fmt.Fprintf(stdout, "\n%s%-10s %s removed %s from stack %s %s\n", Green, "[info]", Grey, key, stk.fqsn, Reset)
+	case "list":
+		cfg, err := s.GetAllConfig(ctx)
+		if err != nil {
+			msg("invalid", "", err)
+		}
+		listConfig(stk, cfg, cmd.showSecrets)
+	}
+	exit(0)
+}
+
+// validInfraConfig checks structured infra config when it is set with aplcli config
+func validInfraConfig(key, value string) error {
+	var err error
+	switch key {
+	case nodePoolsConfig:
+		_, err = infra.ParseNodePools(value)
+	case controlPlaneAclConfig:
+		_, err = infra.ParseControlPlaneAcl(value)
+	case firewallRulesConfig:
+		_, err = infra.ParseFirewallRules(value)
+	case vpcConfig:
+		_, err = infra.ParseVpc(value, "apl")
+	case nodebalancerConfig:
+		_, err = infra.ParseNodeBalancer(value, "apl")
+	case lookupTimeoutConfig:
+		_, _, err = infra.ParseLookupTiming(value, "")
+	case lookupBackoffConfig:
+		_, _, err = infra.ParseLookupTiming("", value)
+	}
+
+	return err
+}
+
+// configKey puts keys without a namespace in the apl namespace, like reconcile does
+func configKey(k string) string {
+	if strings.Contains(k, ":") || k == managedConfig {
+		return k
+	}
+	return "apl:" + k
+}
+
+// configKeys are the keys the stack program reads
+func configKeys(stk microStack) []string {
+	keys := append(slices.Clone(requiredConfig[stk.name]), optionalConfig[stk.name]...)
+	sort.Strings(keys)
+
+	return keys
+}
+
+// validConfigKey rejects keys the stack program never reads, so typos fail before an up does
+func validConfigKey(stk microStack, key, op string) error {
+	if key == managedConfig {
+		if stk.name == "infra" && (op == "get" || op == "list") {
+			return nil
+		}
+		return fmt.Errorf("%s is managed by %s in the infra stack, and cannot be changed", key, prog)
+	}
+
+	keys := configKeys(stk)
+	if slices.Contains(keys, key) {
+		return nil
+	}
+
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return fmt.Errorf("unknown config key %s for stack %s, did you mean %s?", key, stk.name, k)
+		}
+	}
+	return fmt.Errorf("unknown config key %s for stack %s, expected one of %s", key, stk.name, strings.Join(keys, ", "))
+}
+
+func listConfig(stk microStack, cfg auto.ConfigMap, showSecrets bool) {
+	cols := "%s%-28s %s %s%s\n"
+
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(stdout, "\n%s%-10s %s stack: %s %s\n\n", Green, "[info]", Grey, stk.fqsn, Reset)
+	for _, k := range keys {
+		v := cfg[k].Value
+		if cfg[k].Secret && !showSecrets {
+			v = "[secret]"
+		}
+		fmt.Fprintf(stdout, cols, Magenta, k, Grey, v, Reset)
+	}
+
+	// required keys that are not set would fail the next up
+	var missing []string
+	for _, k := range requiredConfig[stk.name] {
+		if _, ok := cfg[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "\n%s%-10s %s missing required config: %s %s\n", Red, "[warn]", Grey, strings.Join(missing, ", "), Reset)
+	}
+}
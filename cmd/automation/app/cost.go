@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// budgetConfig is the optional monthly budget of the infra stack, in USD
+const budgetConfig = "apl:monthlyBudget"
+
+type costItem struct {
+	name     string
+	min, max float64
+}
+
+type estimate struct {
+	items    []costItem
+	min, max float64
+}
+
+func (e *estimate) add(name string, min, max float64) {
+	e.items = append(e.items, costItem{name: name, min: min, max: max})
+	e.min += min
+	e.max += max
+}
+
+// planData is the infra program's config data, from the apl namespace of the stack config
+func planData(cfg auto.ConfigMap) map[string]string {
+	data := map[string]string{}
+	for k, v := range cfg {
+		if name, ok := strings.CutPrefix(k, "apl:"); ok {
+			data[name] = v.Value
+		}
+	}
+
+	return data
+}
+
+// estimateCost prices the planned infra with the linode type and pricing data of the region
+func estimateCost(ctx context.Context, c *linodeClient, data map[string]string) (*estimate, error) {
+	region := data["region"]
+	if region == "" {
+		return nil, fmt.Errorf("apl:region is not set")
+	}
+	e := &estimate{}
+
+	// lke: nodes run between the pool count, or the autoscaler min and max
+	pools, err := infra.PlannedPools(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, np := range pools {
+		var t priceType
+		if err := c.get(ctx, "/linode/types/"+np.Type, &t); err != nil {
+			return nil, fmt.Errorf("node type %s: %w", np.Type, err)
+		}
+		low, high := np.Count, np.Count
+		if np.Autoscaler {
+			low, high = np.Min, np.Max
+		}
+		name := fmt.Sprintf("lke %s nodes %dx-%dx %s", np.Name, low, high, np.Type)
+		if low == high {
+			name = fmt.Sprintf("lke %s nodes %dx %s", np.Name, low, np.Type)
+		}
+		p := t.monthly(region)
+		e.add(name, p*float64(low), p*float64(high))
+	}
+
+	cp, err := infra.PlannedControlPlane(data)
+	if err != nil {
+		return nil, err
+	}
+	if cp.HA {
+		lke, err := list[priceType](ctx, c, "/lke/types")
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range lke {
+			if t.Id == "lke-ha" {
+				p := t.monthly(region)
+				e.add("lke ha control plane", p, p)
+			}
+		}
+	}
+
+	nb, _, err := prices(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	p := nb.monthly(region)
+	e.add("nodebalancer", p, p)
+
+	// object storage is a flat monthly fee for all buckets, up to the included storage and transfer
+	obj, err := list[priceType](ctx, c, "/object-storage/types")
+	if err != nil {
+		return nil, err
+	}
+	if len(obj) > 0 {
+		p := obj[0].monthly(region)
+		e.add(fmt.Sprintf("object storage, %d buckets", len(infra.BucketLabels())), p, p)
+	}
+
+	e.add("dns", 0, 0)
+
+	return e, nil
+}
+
+func (e *estimate) print(region string) {
+	cols := "%s%-10s %s %-40s %s%s\n"
+	fmt.Fprintf(stdout, "\n%s%-10s %s monthly cost estimate in %s %s\n", Green, "[cost]", Grey, region, Reset)
+	for _, i := range e.items {
+		fmt.Fprintf(stdout, cols, Grey, "", "", i.name, costRange(i.min, i.max), Reset)
+	}
+	fmt.Fprintf(stdout, cols, Magenta, "", Grey, "total", costRange(e.min, e.max), Reset)
+}
+
+func costRange(min, max float64) string {
+	if min == max {
+		return fmt.Sprintf("$%.2f", min)
+	}
+	return fmt.Sprintf("$%.2f - $%.2f", min, max)
+}
+
+// checkBudget estimates the infra stack, and fails when the most it can cost exceeds the budget
+func checkBudget(ctx context.Context, s auto.Stack) error {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return err
+	}
+	data := planData(cfg)
+
+	var budget float64
+	if v, ok := cfg[budgetConfig]; ok && v.Value != "" {
+		budget, err = strconv.ParseFloat(strings.TrimPrefix(v.Value, "$"), 64)
+		if err != nil {
+			return fmt.Errorf("%s is not a number: %s", budgetConfig, v.Value)
+		}
+	}
+
+	e, err := estimateCost(ctx, newLinodeClient(), data)
+	if err != nil {
+		// without a budget the estimate is informational only
+		if budget == 0 {
+			fmt.Fprintf(stdout, "\n%s%-10s %s failed to estimate cost: %v %s\n", Red, "[warn]", Grey, err, Reset)
+			return nil
+		}
+		return fmt.Errorf("failed to estimate cost against the budget: %w", err)
+	}
+	e.print(data["region"])
+
+	if budget > 0 && e.max > budget {
+		return fmt.Errorf("estimate of up to $%.2f a month exceeds the budget of $%.2f, see %s", e.max, budget, budgetConfig)
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+const pulumiApi = "https://api.pulumi.com/api"
+
+// config keys that cmd/infra/main.go and cmd/apl/main.go Require
+var requiredConfig = map[string][]string{
+	"infra": {
+		"linode:token",
+		"apl:domain",
+		"apl:label",
+		"apl:email",
+		"apl:region",
+	},
+	"apl": {
+		"linode:token",
+		"apl:domain",
+		"apl:infraSlug",
+		"apl:region",
+		"apl:email",
+		"apl:label",
+		"apl:otomiAdminPassword",
+		"apl:teamDevelopPassword",
+		"apl:agePublicKey",
+		"apl:agePrivateKey",
+		"apl:lokiAdminPassword",
+	},
+}
+
+type check struct {
+	name string
+	hint string
+	fn   func(ctx context.Context) error
+}
+
+type region struct {
+	Id           string   `json:"id"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func doctor(ctx context.Context, cmd *clicmd) {
+	var (
+		cfg    auto.ConfigMap
+		failed int
+	)
+
+	// stack config is shared by the later checks, so load it up front
+	var names []string
+	for _, stk := range cmd.targets() {
+		names = append(names, stk.name)
+	}
+	sort.Strings(names)
+
+	checks := []check{
+		{
+			name: "kubectl is installed",
+			hint: "destroy drains the cluster with kubectl, install it and make sure it is in your $PATH",
+			fn: func(context.Context) error {
+				_, err := exec.LookPath("kubectl")
+				return err
+			},
+		},
+		{
+			name: "LINODE_TOKEN is valid",
+			hint: "export LINODE_TOKEN=<TOKEN> with read/write access to linodes, lke, domains, nodebalancers and object storage",
+			fn:   checkLinodeToken,
+		},
+		{
+			name: "PULUMI_ACCESS_TOKEN is valid",
+			hint: "export PULUMI_ACCESS_TOKEN=<TOKEN>, see https://app.pulumi.com/account/tokens",
+			fn:   checkPulumiToken,
+		},
+	}
+
+	for _, name := range names {
+		stk := cmd.stacks[name]
+		checks = append(checks, check{
+			name: fmt.Sprintf("esc environment has the %s stack config", name),
+			hint: "add the missing keys to the pulumiConfig block of the esc environment, see README.md",
+			fn: func(ctx context.Context) error {
+				c, err := stackConfig(ctx, stk)
+				if err != nil {
+					return err
+				}
+				if cfg == nil {
+					cfg = c
+				}
+				return checkRequiredConfig(c, requiredConfig[name])
+			},
+		})
+	}
+
+	checks = append(checks,
+		check{
+			name: "domain nameservers point at linode",
+			hint: "set the domain's nameservers to ns1.linode.com through ns5.linode.com at your registrar",
+			fn: func(context.Context) error {
+				return checkNameservers(cfg["apl:domain"].Value)
+			},
+		},
+		check{
+			name: "region supports lke and object storage",
+			hint: "pick a region that lists Kubernetes and Object Storage, see https://api.linode.com/v4/regions",
+			fn: func(ctx context.Context) error {
+				return checkRegion(ctx, cfg["apl:region"].Value)
+			},
+		},
+	)
+
+	for _, c := range checks {
+		cctx, span := tracer.Start(ctx, c.name)
+		err := c.fn(cctx)
+		endSpan(span, err)
+		if err == nil {
+			fmt.Printf("%s%-10s %s %s%s\n", Green, "[pass]", Grey, c.name, Reset)
+			continue
+		}
+
+		failed++
+		fmt.Printf("%s%-10s %s %s: %v%s\n", Red, "[fail]", Grey, c.name, err, Reset)
+		fmt.Printf("%s%-10s %s %s%s\n", Magenta, "", Grey, c.hint, Reset)
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%s%-10s %s %d of %d checks failed%s\n", Red, "[error]", Grey, failed, len(checks), Reset)
+		exit(1)
+	}
+	fmt.Printf("\n%s%-10s %s all checks passed%s\n", Green, "[info]", Grey, Reset)
+	exit(0)
+}
+
+func stackConfig(ctx context.Context, stk microStack) (auto.ConfigMap, error) {
+	s, err := auto.SelectStackLocalSource(ctx, stk.fqsn, stackDir(stk))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select stack %s: %w", stk.fqsn, err)
+	}
+
+	return s.GetAllConfig(ctx)
+}
+
+func checkRequiredConfig(cfg auto.ConfigMap, keys []string) error {
+	var missing []string
+	for _, k := range keys {
+		if v, ok := cfg[k]; !ok || v.Value == "" {
+			missing = append(missing, k)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func checkLinodeToken(ctx context.Context) error {
+	c := newLinodeClient()
+	if c.token == "" {
+		return fmt.Errorf("LINODE_TOKEN is not set")
+	}
+
+	return c.get(ctx, "/profile", nil)
+}
+
+func checkPulumiToken(ctx context.Context) error {
+	token := os.Getenv("PULUMI_ACCESS_TOKEN")
+	if token == "" {
+		return fmt.Errorf("PULUMI_ACCESS_TOKEN is not set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pulumiApi+"/user", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.pulumi+8")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("pulumi api: %s", res.Status)
+	}
+	return nil
+}
+
+func checkNameservers(domain string) error {
+	if domain == "" {
+		return fmt.Errorf("apl:domain is not set")
+	}
+
+	ns, err := net.LookupNS(domain)
+	if err != nil {
+		return err
+	}
+
+	var other []string
+	for _, n := range ns {
+		host := strings.TrimSuffix(strings.ToLower(n.Host), ".")
+		if !strings.HasSuffix(host, ".linode.com") {
+			other = append(other, host)
+		}
+	}
+
+	if len(other) > 0 {
+		return fmt.Errorf("%s uses %s", domain, strings.Join(other, ", "))
+	}
+	return nil
+}
+
+func checkRegion(ctx context.Context, id string) error {
+	var r region
+	if id == "" {
+		return fmt.Errorf("apl:region is not set")
+	}
+
+	err := newLinodeClient().get(ctx, "/regions/"+id, &r)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, c := range []string{"Kubernetes", "Object Storage"} {
+		if !slices.Contains(r.Capabilities, c) {
+			missing = append(missing, c)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s does not support %s", id, strings.Join(missing, ", "))
+	}
+	return nil
+}
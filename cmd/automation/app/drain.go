@@ -0,0 +1,283 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/rylabs-billy/steal-this-idp/utils"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+const (
+	preserveAnnotation = "service.beta.kubernetes.io/linode-loadbalancer-preserve"
+	nbIdAnnotation     = "service.beta.kubernetes.io/linode-loadbalancer-nodebalancer-id"
+	drainPoll          = 10 * time.Second
+)
+
+type drainOptions struct {
+	keepPreserved bool
+	timeout       time.Duration
+
+	// managedId is the nodebalancer the infra stack owns in managed mode, which pulumi deletes
+	managedId string
+}
+
+// kubeObject is the part of a service, pvc or pv that drain reads
+type kubeObject struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Type                          string `json:"type"`
+		VolumeName                    string `json:"volumeName"`
+		PersistentVolumeReclaimPolicy string `json:"persistentVolumeReclaimPolicy"`
+		Csi                           *struct {
+			VolumeHandle string `json:"volumeHandle"`
+		} `json:"csi"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				Ip string `json:"ip"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+type kubeList struct {
+	Items []kubeObject `json:"items"`
+}
+
+type kubectl struct {
+	kubeconfig string
+}
+
+func (k kubectl) run(ctx context.Context, args ...string) ([]byte, error) {
+	args = append([]string{"--kubeconfig", k.kubeconfig}, args...)
+	out, err := exec.CommandContext(ctx, "kubectl", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl %s: %w: %s", strings.Join(args[2:], " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return out, nil
+}
+
+func (k kubectl) list(ctx context.Context, kind string) (kubeList, error) {
+	var l kubeList
+
+	args := []string{"get", kind, "-o", "json"}
+	if kind != "pv" {
+		args = append(args, "--all-namespaces")
+	}
+	out, err := k.run(ctx, args...)
+	if err != nil {
+		return l, err
+	}
+
+	return l, json.Unmarshal(out, &l)
+}
+
+// drain deletes the loadbalancer services and pvcs of the cluster, and waits for the cloud
+// controller and csi driver to release their nodebalancers and volumes, which pulumi doesn't track
+func drain(ctx context.Context, s auto.Stack, opts drainOptions) error {
+	out, err := s.Outputs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// nothing was deployed, or the cluster is already gone
+	enc, _ := out["kubeconfig"].Value.(string)
+	if enc == "" {
+		return nil
+	}
+	cfg, err := utils.DecodeKubeConfig("", enc, false)
+	if err != nil {
+		return fmt.Errorf("failed to decode the kubeconfig output: %w", err)
+	}
+
+	if managed, _ := out["loadbalancerManaged"].Value.(bool); managed {
+		opts.managedId, _ = out["loadbalancerId"].Value.(string)
+	}
+
+	f, err := os.CreateTemp("", prog+"-kubeconfig-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(cfg); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	k := kubectl{kubeconfig: f.Name()}
+
+	ips, err := drainServices(ctx, k, opts)
+	if err != nil {
+		return err
+	}
+	vols, err := drainVolumes(ctx, k, opts)
+	if err != nil {
+		return err
+	}
+
+	return waitReleased(ctx, newLinodeClient(), ips, vols)
+}
+
+// drainServices deletes the loadbalancer services, and returns the addresses of their nodebalancers
+func drainServices(ctx context.Context, k kubectl, opts drainOptions) ([]string, error) {
+	svcs, err := k.list(ctx, "services")
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for _, svc := range svcs.Items {
+		if svc.Spec.Type != "LoadBalancer" {
+			continue
+		}
+		name := svc.Metadata.Namespace + "/" + svc.Metadata.Name
+		ns := []string{"--namespace", svc.Metadata.Namespace}
+
+		// the infra stack deletes its own nodebalancer, the service only adopted it
+		if opts.managedId != "" && svc.Metadata.Annotations[nbIdAnnotation] == opts.managedId {
+			fmt.Fprintf(stdout, "\n%s%-10s %s keeping service %s of the managed nodebalancer %s\n", Green, "[drain]", Grey, name, Reset)
+			continue
+		}
+
+		// the cloud controller keeps the nodebalancer of a preserved service, unless the annotation is removed
+		if svc.Metadata.Annotations[preserveAnnotation] == "true" {
+			if opts.keepPreserved {
+				fmt.Fprintf(stdout, "\n%s%-10s %s keeping preserved service %s %s\n", Green, "[drain]", Grey, name, Reset)
+				continue
+			}
+			_, err := k.run(ctx, append(ns, "annotate", "service", svc.Metadata.Name, preserveAnnotation+"-")...)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err := k.run(ctx, append(ns, "delete", "service", svc.Metadata.Name, "--wait=false")...)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "\n%s%-10s %s deleted service %s %s\n", Green, "[drain]", Grey, name, Reset)
+
+		for _, i := range svc.Status.LoadBalancer.Ingress {
+			ips = append(ips, i.Ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// drainVolumes deletes the pvcs, and returns the ids of the linode volumes behind them
+func drainVolumes(ctx context.Context, k kubectl, opts drainOptions) ([]int, error) {
+	pvcs, err := k.list(ctx, "pvc")
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := k.list(ctx, "pv")
+	if err != nil {
+		return nil, err
+	}
+
+	var vols []int
+	for _, pvc := range pvcs.Items {
+		name := pvc.Metadata.Namespace + "/" + pvc.Metadata.Name
+		ns := []string{"--namespace", pvc.Metadata.Namespace}
+
+		i := slices.IndexFunc(pvs.Items, func(pv kubeObject) bool {
+			return pv.Metadata.Name == pvc.Spec.VolumeName
+		})
+
+		// the csi driver keeps the volume of a retained pv, unless the policy is changed
+		var pv *kubeObject
+		if i >= 0 {
+			pv = &pvs.Items[i]
+		}
+		if pv != nil && pv.Spec.PersistentVolumeReclaimPolicy == "Retain" {
+			if opts.keepPreserved {
+				fmt.Fprintf(stdout, "\n%s%-10s %s keeping retained pvc %s %s\n", Green, "[drain]", Grey, name, Reset)
+				continue
+			}
+			patch := `{"spec":{"persistentVolumeReclaimPolicy":"Delete"}}`
+			_, err := k.run(ctx, "patch", "pv", pv.Metadata.Name, "--patch", patch)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err := k.run(ctx, append(ns, "delete", "pvc", pvc.Metadata.Name, "--wait=false")...)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "\n%s%-10s %s deleted pvc %s %s\n", Green, "[drain]", Grey, name, Reset)
+
+		// linode volume handles are <id>-<label>
+		if pv != nil && pv.Spec.Csi != nil {
+			id, _, _ := strings.Cut(pv.Spec.Csi.VolumeHandle, "-")
+			if n, err := strconv.Atoi(id); err == nil {
+				vols = append(vols, n)
+			}
+		}
+	}
+
+	return vols, nil
+}
+
+// waitReleased polls the linode api until the nodebalancers and volumes are gone
+func waitReleased(ctx context.Context, c *linodeClient, ips []string, vols []int) error {
+	if len(ips) == 0 && len(vols) == 0 {
+		return nil
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s waiting for %d nodebalancers and %d volumes to be released %s\n", Green, "[drain]", Grey, len(ips), len(vols), Reset)
+
+	for {
+		var pending []string
+
+		nbs, err := list[nodebalancer](ctx, c, "/nodebalancers")
+		if err != nil {
+			return err
+		}
+		for _, nb := range nbs {
+			if slices.Contains(ips, nb.Ipv4) {
+				pending = append(pending, "nodebalancer "+nb.Label)
+			}
+		}
+
+		for _, id := range vols {
+			err := c.get(ctx, fmt.Sprintf("/volumes/%d", id), nil)
+			switch {
+			case isNotFound(err):
+			case err != nil:
+				return err
+			default:
+				pending = append(pending, fmt.Sprintf("volume %d", id))
+			}
+		}
+
+		if len(pending) == 0 {
+			fmt.Fprintf(stdout, "\n%s%-10s %s nodebalancers and volumes are released %s\n", Green, "[drain]", Grey, Reset)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s to be released, see aplcli sweep", strings.Join(pending, ", "))
+		case <-time.After(drainPoll):
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the nodebalancer is created by the cloud controller, so it is checked
+// through the linode api rather than the stack state
+const nodebalancerType = "linode:cloud-controller/nodeBalancer"
+
+type driftMetrics struct {
+	drifted     *prometheus.GaugeVec
+	lastSuccess *prometheus.GaugeVec
+	lastDrift   *prometheus.GaugeVec
+	errors      *prometheus.CounterVec
+}
+
+type nodebalancer struct {
+	Id     int      `json:"id"`
+	Label  string   `json:"label"`
+	Region string   `json:"region"`
+	Ipv4   string   `json:"ipv4"`
+	Tags   []string `json:"tags"`
+}
+
+func newDriftMetrics(reg prometheus.Registerer) *driftMetrics {
+	m := &driftMetrics{
+		drifted: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "aplcli_drifted_resources",
+			Help: "Resources that differ from the stack state at the last check.",
+		}, []string{"stack", "type"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "aplcli_drift_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful drift check.",
+		}, []string{"stack"}),
+		lastDrift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "aplcli_drift_last_detected_timestamp_seconds",
+			Help: "Unix time of the last drift check that found drift.",
+		}, []string{"stack"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aplcli_drift_check_errors_total",
+			Help: "Drift checks that failed to run.",
+		}, []string{"stack"}),
+	}
+	reg.MustRegister(m.drifted, m.lastSuccess, m.lastDrift, m.errors)
+
+	return m
+}
+
+func drift(ctx context.Context, cmd *clicmd) {
+	reg := prometheus.NewRegistry()
+	metrics := newDriftMetrics(reg)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.ListenAndServe(cmd.addr, mux)
+		msg("invalid", "", err)
+	}()
+	fmt.Fprintf(stdout, "\n%s%-10s %s serving drift metrics on %s/metrics %s\n", Green, "[info]", Grey, cmd.addr, Reset)
+
+	for {
+		cctx, span := tracer.Start(ctx, prog+" drift", trace.WithNewRoot())
+		for _, stk := range cmd.targets() {
+			counts, err := checkDrift(cctx, stk)
+			if err != nil {
+				metrics.errors.WithLabelValues(stk.fqsn).Inc()
+				fmt.Fprintf(stdout, "\n%s%-10s %s drift check failed for %s: %v %s\n", Red, "[error]", Grey, stk.fqsn, err, Reset)
+				continue
+			}
+			metrics.record(stk.fqsn, counts)
+		}
+		span.End()
+
+		time.Sleep(cmd.interval)
+	}
+}
+
+func (m *driftMetrics) record(fqsn string, counts map[string]int) {
+	now := float64(time.Now().Unix())
+	total := 0
+
+	m.drifted.DeletePartialMatch(prometheus.Labels{"stack": fqsn})
+	for typ, n := range counts {
+		m.drifted.WithLabelValues(fqsn, typ).Set(float64(n))
+		total += n
+	}
+
+	m.lastSuccess.WithLabelValues(fqsn).Set(now)
+	if total > 0 {
+		m.lastDrift.WithLabelValues(fqsn).Set(now)
+		fmt.Fprintf(stdout, "\n%s%-10s %s %d drifted resources in %s %s\n", Magenta, "[drift]", Grey, total, fqsn, Reset)
+		return
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s no drift in %s %s\n", Green, "[info]", Grey, fqsn, Reset)
+}
+
+// checkDrift runs a preview-only refresh, and counts drifted resources by type
+func checkDrift(ctx context.Context, stk microStack) (counts map[string]int, err error) {
+	counts = map[string]int{}
+	ctx, span := stackSpan(ctx, "stack "+stk.name, stk)
+	defer func() { endSpan(span, err) }()
+
+	s, err := localStack(ctx, stk)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan events.EngineEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seen := map[string]bool{}
+		for e := range ch {
+			var md *apitype.StepEventMetadata
+			switch {
+			case e.ResourcePreEvent != nil:
+				md = &e.ResourcePreEvent.Metadata
+			case e.ResOutputsEvent != nil:
+				md = &e.ResOutputsEvent.Metadata
+			default:
+				continue
+			}
+
+			if !seen[md.URN] && drifted(md) {
+				seen[md.URN] = true
+				counts[md.Type]++
+			}
+		}
+	}()
+
+	chs := []chan<- events.EngineEvent{ch}
+	if tracing {
+		chs = append(chs, traceEvents(ctx, stk))
+	}
+	_, err = s.PreviewRefresh(ctx, optrefresh.EventStreams(chs...))
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	if stk.name == "infra" {
+		n, err := nodebalancerDrift(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			counts[nodebalancerType] = n
+		}
+	}
+
+	return counts, nil
+}
+
+// drifted reports refresh steps where the provider state no longer matches the stack
+func drifted(md *apitype.StepEventMetadata) bool {
+	if md.Type == "pulumi:pulumi:Stack" || strings.HasPrefix(md.Type, "pulumi:providers:") {
+		return false
+	}
+
+	switch md.Op {
+	case apitype.OpUpdate, apitype.OpDelete, apitype.OpReplace:
+		return true
+	case apitype.OpRefresh:
+		return md.New == nil || len(md.Diffs) > 0 || len(md.DetailedDiff) > 0
+	}
+	return false
+}
+
+// nodebalancerDrift checks that the recorded nodebalancer still exists, with its tag and address.
+// A managed nodebalancer is a resource of the stack, and the refresh already checks it
+func nodebalancerDrift(ctx context.Context, s auto.Stack) (int, error) {
+	out, err := s.Outputs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if managed, _ := out["loadbalancerManaged"].Value.(bool); managed {
+		return 0, nil
+	}
+
+	id, _ := out["loadbalancerId"].Value.(string)
+	ipv4, _ := out["ipv4"].Value.(string)
+	if id == "" {
+		return 0, nil
+	}
+
+	var nb nodebalancer
+	err = newLinodeClient().get(ctx, "/nodebalancers/"+id, &nb)
+	if err != nil {
+		// a deleted nodebalancer is drift, anything else is a failed check
+		if isNotFound(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+
+	if nb.Ipv4 != ipv4 || !slices.Contains(nb.Tags, infra.NodeBalancerTag) {
+		return 1, nil
+	}
+	return 0, nil
+}
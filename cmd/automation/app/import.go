@@ -0,0 +1,349 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optimport"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+)
+
+const (
+	domainType  = "linode:index/domain:Domain"
+	clusterType = "linode:index/lkeCluster:LkeCluster"
+	bucketType  = "linode:index/objectStorageBucket:ObjectStorageBucket"
+
+	// the explicit provider that build declares, and the config of its api url
+	providerType      = "pulumi:providers:linode"
+	providerName      = "linodeProvider"
+	providerUrlConfig = "linode:url"
+)
+
+type domain struct {
+	Id       int      `json:"id"`
+	Domain   string   `json:"domain"`
+	SoaEmail string   `json:"soa_email"`
+	Tags     []string `json:"tags"`
+}
+
+type lkeCluster struct {
+	Id         int      `json:"id"`
+	Label      string   `json:"label"`
+	Region     string   `json:"region"`
+	K8sVersion string   `json:"k8s_version"`
+	Tags       []string `json:"tags"`
+}
+
+type bucket struct {
+	Label   string `json:"label"`
+	Region  string `json:"region"`
+	Cluster string `json:"cluster"`
+}
+
+// adoption is a discovered resource, with the config that build needs to
+// declare it under the same logical name
+type adoption struct {
+	resource *optimport.ImportResource
+	config   auto.ConfigMap
+}
+
+// importResources adopts an existing dns zone, lke cluster and buckets into the infra stack
+func importResources(ctx context.Context, cmd *clicmd) {
+	stk := cmd.stacks["infra"]
+	s := initLocalStack(ctx, stk)
+
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	// flags win over the config of the stack
+	name := cmd.domain
+	if name == "" {
+		name = cfg["apl:domain"].Value
+	}
+	label := cmd.cluster
+	if label == "" {
+		label = cfg["apl:label"].Value
+	}
+	if name == "" && label == "" && cmd.tag == "" {
+		msg("invalid", "", fmt.Errorf("import requires --domain, --cluster or --tag, or apl:domain and apl:label in the infra stack"))
+	}
+
+	found, err := findAdoptions(ctx, importClient(cfg), name, label, cmd.tag, cfg["apl:region"].Value)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	// resources already in the stack are left alone, so import can run again
+	state, err := stackState(ctx, s)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	managed := stackResources(state)
+
+	var (
+		resources []*optimport.ImportResource
+		config    = auto.ConfigMap{}
+	)
+	for _, a := range found {
+		for k, v := range a.config {
+			config[k] = v
+		}
+		if managed[a.resource.Type+"::"+a.resource.Name] {
+			fmt.Fprintf(stdout, "\n%s%-10s %s %s %s is already in the stack %s\n", Green, "[info]", Grey, a.resource.Type, a.resource.Name, Reset)
+			continue
+		}
+		a.resource.Provider = providerName
+		resources = append(resources, a.resource)
+		fmt.Fprintf(stdout, "\n%s%-10s %s found %s %s (%s) %s\n", Green, "[info]", Grey, a.resource.Type, a.resource.Name, a.resource.ID, Reset)
+	}
+
+	if len(resources) == 0 {
+		fmt.Fprintf(stdout, "\n%s%-10s %s nothing to import %s\n", Green, "[info]", Grey, Reset)
+		exit(0)
+	}
+
+	// config first, so the program declares the imported resources under the same names
+	if !cmd.dryRun {
+		if err := s.SetAllConfig(ctx, config); err != nil {
+			msg("invalid", "", err)
+		}
+	}
+
+	// import with the explicit provider of the program, so the resources are not bound to a
+	// default provider that the next up replaces. Only a provider in the state can be referenced
+	provider, ok := linodeProviderURN(state)
+	if !ok {
+		if cmd.dryRun {
+			msg("invalid", "", fmt.Errorf("the linode provider is not in stack %s yet, run import without --dry-run to create it first", stk.fqsn))
+		}
+		if provider, err = createLinodeProvider(ctx, s, stk); err != nil {
+			fmt.Fprintf(stdout, "\n%s%-10s %s failed to create the linode provider in stack: %s%s\n", Red, "[error]", Grey, stk.fqsn, Reset)
+			msg("invalid", "", err)
+		}
+	}
+
+	_, err = s.ImportResources(ctx,
+		optimport.Resources(resources),
+		optimport.NameTable(map[string]string{providerName: provider}),
+		optimport.Protect(false),
+		optimport.GenerateCode(false),
+		optimport.PreviewOnly(cmd.dryRun),
+		optimport.ProgressStreams(os.Stdout),
+	)
+	if err != nil {
+		fmt.Fprintf(stdout, "\n%s%-10s %s failed to import into stack: %s%s\n", Red, "[error]", Grey, stk.fqsn, Reset)
+		msg("invalid", "", err)
+	}
+
+	if !cmd.dryRun {
+		fmt.Fprintf(stdout, "\n%s%-10s %s imported %d resources into stack: %s %s\n", Green, "[info]", Grey, len(resources), stk.fqsn, Reset)
+	}
+	exit(0)
+}
+
+// importClient discovers on the api that the linode provider of the stack uses, e.g. a local
+// stand-in, unless LINODE_URL points elsewhere
+func importClient(cfg auto.ConfigMap) *linodeClient {
+	c := newLinodeClient()
+	if url := cfg[providerUrlConfig].Value; url != "" && os.Getenv("LINODE_URL") == "" {
+		c.url = strings.TrimRight(url, "/")
+	}
+	return c
+}
+
+// findAdoptions discovers the dns zone, the lke cluster and the buckets of a platform. The
+// buckets are looked up in the region of the cluster, or the given region without one
+func findAdoptions(ctx context.Context, c *linodeClient, name, label, tag, region string) ([]adoption, error) {
+	var found []adoption
+
+	d, err := findDomain(ctx, c, name, tag)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		found = append(found, adoption{
+			resource: &optimport.ImportResource{Type: domainType, Name: d.Domain, ID: strconv.Itoa(d.Id)},
+			config: auto.ConfigMap{
+				"apl:domain": auto.ConfigValue{Value: d.Domain},
+				"apl:email":  auto.ConfigValue{Value: d.SoaEmail},
+			},
+		})
+	}
+
+	lke, err := findCluster(ctx, c, label, tag)
+	if err != nil {
+		return nil, err
+	}
+	if lke != nil {
+		// the version and pools of the cluster as it is, so the next create doesn't change them
+		pools, err := clusterPools(ctx, c, lke.Id)
+		if err != nil {
+			return nil, err
+		}
+		region = lke.Region
+		found = append(found, adoption{
+			resource: &optimport.ImportResource{Type: clusterType, Name: lke.Label, ID: strconv.Itoa(lke.Id)},
+			config: auto.ConfigMap{
+				"apl:label":      auto.ConfigValue{Value: lke.Label},
+				"apl:region":     auto.ConfigValue{Value: lke.Region},
+				k8sVersionConfig: auto.ConfigValue{Value: lke.K8sVersion},
+				nodePoolsConfig:  auto.ConfigValue{Value: pools},
+			},
+		})
+	}
+
+	// buckets have no tags, so they are found by the labels that build uses
+	if region == "" {
+		return found, nil
+	}
+	buckets, err := list[bucket](ctx, c, "/object-storage/buckets/"+region)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if !slices.Contains(infra.BucketLabels(), b.Label) {
+			continue
+		}
+		// older buckets are addressed by cluster rather than region
+		loc := b.Region
+		if loc == "" {
+			loc = b.Cluster
+		}
+		found = append(found, adoption{
+			resource: &optimport.ImportResource{Type: bucketType, Name: b.Label, ID: loc + ":" + b.Label},
+			config: auto.ConfigMap{
+				"apl:region": auto.ConfigValue{Value: region},
+			},
+		})
+	}
+
+	return found, nil
+}
+
+// clusterPools returns the pools of a cluster as apl:nodePools, in the order of the cluster,
+// since build matches pools by position. The platform tags are left out, build adds them
+func clusterPools(ctx context.Context, c *linodeClient, id int) (string, error) {
+	pools, err := list[lkePool](ctx, c, fmt.Sprintf("/lke/clusters/%d/pools", id))
+	if err != nil {
+		return "", err
+	}
+
+	nodePools := make([]infra.NodePool, 0, len(pools))
+	for _, p := range pools {
+		np := infra.NodePool{
+			Name:   fmt.Sprintf("pool-%d", p.Id),
+			Type:   p.Type,
+			Count:  p.Count,
+			Labels: p.Labels,
+			Tags:   slices.DeleteFunc(slices.Clone(p.Tags), func(t string) bool { return slices.Contains(infra.PlatformTags(), t) }),
+			Taints: p.Taints,
+		}
+		if p.Autoscaler.Enabled {
+			np.Min, np.Max = p.Autoscaler.Min, p.Autoscaler.Max
+		}
+		nodePools = append(nodePools, np)
+	}
+
+	b, err := json.Marshal(nodePools)
+	return string(b), err
+}
+
+func findDomain(ctx context.Context, c *linodeClient, name, tag string) (*domain, error) {
+	domains, err := list[domain](ctx, c, "/domains")
+	if err != nil {
+		return nil, err
+	}
+
+	return findOne(domains, "domain", func(d domain) bool {
+		return (name != "" && d.Domain == name) || (name == "" && tag != "" && slices.Contains(d.Tags, tag))
+	})
+}
+
+func findCluster(ctx context.Context, c *linodeClient, label, tag string) (*lkeCluster, error) {
+	clusters, err := list[lkeCluster](ctx, c, "/lke/clusters")
+	if err != nil {
+		return nil, err
+	}
+
+	return findOne(clusters, "lke cluster", func(l lkeCluster) bool {
+		return (label != "" && l.Label == label) || (label == "" && tag != "" && slices.Contains(l.Tags, tag))
+	})
+}
+
+// findOne returns the single match, nothing when there is none, and fails when a tag is ambiguous
+func findOne[T any](items []T, kind string, match func(T) bool) (*T, error) {
+	var found []T
+	for _, i := range items {
+		if match(i) {
+			found = append(found, i)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("%d %s resources match, select one by name or label instead of tag", len(found), kind)
+}
+
+// stackResources returns the type::name of every resource in the stack state
+func stackResources(state []stateResource) map[string]bool {
+	managed := map[string]bool{}
+	for _, r := range state {
+		managed[r.Type+"::"+urnName(r.URN)] = true
+	}
+
+	return managed
+}
+
+// linodeProviderURN returns the urn of the explicit linode provider in the stack state
+func linodeProviderURN(state []stateResource) (string, bool) {
+	for _, r := range state {
+		if r.Type == providerType && urnName(r.URN) == providerName {
+			return r.URN, true
+		}
+	}
+	return "", false
+}
+
+// createLinodeProvider deploys only the explicit linode provider of the program, so that
+// resources can be imported with it into a new stack
+func createLinodeProvider(ctx context.Context, s auto.Stack, stk microStack) (string, error) {
+	project, err := s.Workspace().ProjectSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+	stack := s.Name()
+	if i := strings.LastIndex(stack, "/"); i >= 0 {
+		stack = stack[i+1:]
+	}
+
+	urn := fmt.Sprintf("urn:pulumi:%s::%s::%s::%s", stack, project.Name, providerType, providerName)
+	if _, err := s.Up(ctx, colorUp{}, optup.Target([]string{urn}), optup.ProgressStreams(stdout)); err != nil {
+		return "", err
+	}
+
+	return urn, nil
+}
+
+// urnName is the logical name at the end of a urn
+func urnName(urn string) string {
+	for i := len(urn) - 1; i > 0; i-- {
+		if urn[i] == ':' && urn[i-1] == ':' {
+			return urn[i+1:]
+		}
+	}
+	return urn
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+func TestFindAdoptionsWithProvider(t *testing.T) {
+	url := linodeStandIn(t, map[string]any{
+		"/domains": []domain{
+			{Id: 1, Domain: "example.com", SoaEmail: "ops@example.com"},
+			{Id: 2, Domain: "example.org", SoaEmail: "ops@example.org"},
+		},
+		"/lke/clusters": []lkeCluster{
+			{Id: 3, Label: "apl-demo", Region: "us-ord", K8sVersion: "1.32"},
+			{Id: 4, Label: "apl-other", Region: "us-sea"},
+		},
+		"/lke/clusters/3/pools": []map[string]any{
+			{"id": 31, "type": "g6-dedicated-8", "count": 4, "tags": []string{"marketplace", "apl", "dev", "team-a"},
+				"autoscaler": map[string]any{"enabled": true, "min": 3, "max": 6}},
+			{"id": 32, "type": "g6-standard-4", "count": 2, "labels": map[string]string{"role": "build"},
+				"taints": []infra.Taint{{Key: "build", Value: "true", Effect: "NoSchedule"}}},
+		},
+		"/object-storage/buckets/us-ord": []bucket{
+			{Label: "apl-loki", Region: "us-ord"},
+			{Label: "apl-harbor", Cluster: "us-ord-1"},
+			{Label: "backups", Region: "us-ord"},
+		},
+	})
+	// the provider points at the stand-in through the stack config, not the environment
+	t.Setenv("LINODE_URL", "")
+
+	c := importClient(auto.ConfigMap{providerUrlConfig: auto.ConfigValue{Value: url + "/"}})
+	if c.url != url {
+		t.Fatalf("got client url %s, want the url of the provider %s", c.url, url)
+	}
+
+	found, err := findAdoptions(context.Background(), c, "example.com", "apl-demo", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		domainType + "::example.com": "1",
+		clusterType + "::apl-demo":   "3",
+		bucketType + "::apl-loki":    "us-ord:apl-loki",
+		bucketType + "::apl-harbor":  "us-ord-1:apl-harbor",
+	}
+	if len(found) != len(want) {
+		t.Fatalf("got %d adoptions, want %d", len(found), len(want))
+	}
+	for _, a := range found {
+		r := a.resource
+		if id, ok := want[r.Type+"::"+r.Name]; !ok || id != r.ID {
+			t.Errorf("got %s %s (%s), want one of %v", r.Type, r.Name, r.ID, want)
+		}
+	}
+
+	// the cluster keeps its version and pools, so the next create leaves them alone
+	cfg := found[1].config
+	if v := cfg[k8sVersionConfig].Value; v != "1.32" {
+		t.Errorf("got %s %q, want the version of the cluster 1.32", k8sVersionConfig, v)
+	}
+	pools, err := infra.PlannedPools(map[string]string{"label": "apl-demo", "nodePools": cfg[nodePoolsConfig].Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 {
+		t.Fatalf("got %d pools, want the 2 of the cluster", len(pools))
+	}
+	autoscaled, fixed := pools[0], pools[1]
+	if autoscaled.Type != "g6-dedicated-8" || !autoscaled.Autoscaler || autoscaled.Count != 4 || autoscaled.Min != 3 || autoscaled.Max != 6 {
+		t.Errorf("got pool %+v, want 4 g6-dedicated-8 nodes autoscaled from 3 to 6", autoscaled)
+	}
+	if !slices.Equal(autoscaled.Tags, append(infra.PlatformTags(), "team-a")) {
+		t.Errorf("got tags %v, want the platform tags once and team-a", autoscaled.Tags)
+	}
+	if fixed.Type != "g6-standard-4" || fixed.Autoscaler || fixed.Count != 2 || fixed.Labels["role"] != "build" || len(fixed.Taints) != 1 {
+		t.Errorf("got pool %+v, want 2 g6-standard-4 nodes with the build label and taint", fixed)
+	}
+
+	state := []stateResource{
+		{URN: "urn:pulumi:dev::infra::pulumi:pulumi:Stack::infra-dev", Type: "pulumi:pulumi:Stack"},
+		{URN: "urn:pulumi:dev::infra::pulumi:providers:kubernetes::linodeProvider", Type: "pulumi:providers:kubernetes"},
+		{URN: "urn:pulumi:dev::infra::pulumi:providers:linode::linodeProvider", Type: providerType, ID: "0b5c"},
+	}
+	urn, ok := linodeProviderURN(state)
+	if !ok || urn != "urn:pulumi:dev::infra::pulumi:providers:linode::linodeProvider" {
+		t.Fatalf("got provider %q, want the linode provider of the stack", urn)
+	}
+	if _, ok := linodeProviderURN(state[:2]); ok {
+		t.Fatal("found a linode provider in a stack without one")
+	}
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// stateResource is the part of a resource in an exported deployment that aplcli reads
+type stateResource struct {
+	URN     string         `json:"urn"`
+	Type    string         `json:"type"`
+	ID      string         `json:"id"`
+	Parent  string         `json:"parent"`
+	Inputs  map[string]any `json:"inputs"`
+	Outputs map[string]any `json:"outputs"`
+}
+
+// inventoryItem is one row of the report
+type inventoryItem struct {
+	Stack  string   `json:"stack"`
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	ID     string   `json:"id"`
+	Label  string   `json:"label"`
+	Region string   `json:"region"`
+	Tags   []string `json:"tags"`
+	Parent string   `json:"parent"`
+}
+
+// stackState returns the resources of the last exported deployment of a stack
+func stackState(ctx context.Context, s auto.Stack) ([]stateResource, error) {
+	state, err := s.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployment struct {
+		Resources []stateResource `json:"resources"`
+	}
+	if len(state.Deployment) > 0 {
+		if err := json.Unmarshal(state.Deployment, &deployment); err != nil {
+			return nil, err
+		}
+	}
+
+	return deployment.Resources, nil
+}
+
+func inventory(ctx context.Context, cmd *clicmd) {
+	var items []inventoryItem
+
+	switch cmd.output {
+	case "table", "csv", "json":
+	default:
+		msg("invalid", "", fmt.Errorf("unknown output %q, expected one of table, csv, json", cmd.output))
+	}
+
+	for _, stk := range cmd.targets() {
+		s, err := auto.SelectStackLocalSource(ctx, stk.fqsn, stackDir(stk))
+		if err != nil {
+			msg("invalid", "", fmt.Errorf("failed to select stack %s: %w", stk.fqsn, err))
+		}
+
+		state, err := stackState(ctx, s)
+		if err != nil {
+			msg("invalid", "", fmt.Errorf("failed to export stack %s: %w", stk.fqsn, err))
+		}
+		items = append(items, inventoryItems(stk, state)...)
+	}
+
+	var err error
+	switch cmd.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(items)
+	case "csv":
+		err = writeInventoryCsv(items)
+	case "table":
+		err = writeInventoryTable(items)
+	}
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	exit(0)
+}
+
+// inventoryItems reports every resource of a stack, but the stack itself and its providers
+func inventoryItems(stk microStack, state []stateResource) []inventoryItem {
+	var items []inventoryItem
+
+	for _, r := range state {
+		if r.Type == "pulumi:pulumi:Stack" || strings.HasPrefix(r.Type, "pulumi:providers:") {
+			continue
+		}
+
+		item := inventoryItem{
+			Stack:  stk.fqsn,
+			Type:   r.Type,
+			Name:   urnName(r.URN),
+			ID:     r.ID,
+			Label:  stateString(r, "label"),
+			Region: stateString(r, "region"),
+			Tags:   stateStrings(r, "tags"),
+		}
+
+		// kubernetes resources are labelled by metadata, and helm releases by name
+		if item.Label == "" {
+			if md, ok := r.Outputs["metadata"].(map[string]any); ok {
+				item.Label, _ = md["name"].(string)
+			}
+		}
+		if item.Label == "" {
+			item.Label = stateString(r, "name")
+		}
+
+		// components have no id, but are named as the parent of their children, e.g. the loadbalancer Service
+		item.Parent = parentName(r.Parent)
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// parentName is the type::name of a parent component, or blank for the stack
+func parentName(urn string) string {
+	if urn == "" || strings.Contains(urn, "::pulumi:pulumi:Stack::") {
+		return ""
+	}
+
+	// urn:pulumi:<stack>::<project>::<qualified type>::<name>
+	parts := strings.SplitN(urn, "::", 4)
+	if len(parts) < 4 {
+		return urn
+	}
+	typ := parts[2]
+	if i := strings.LastIndex(typ, "$"); i >= 0 {
+		typ = typ[i+1:]
+	}
+
+	return typ + "::" + parts[3]
+}
+
+// stateString reads a string output, or the input when the output is not set
+func stateString(r stateResource, key string) string {
+	for _, m := range []map[string]any{r.Outputs, r.Inputs} {
+		if v, ok := m[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func stateStrings(r stateResource, key string) []string {
+	for _, m := range []map[string]any{r.Outputs, r.Inputs} {
+		l, ok := m[key].([]any)
+		if !ok {
+			continue
+		}
+
+		var values []string
+		for _, v := range l {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func writeInventoryTable(items []inventoryItem) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tTYPE\tNAME\tID\tLABEL\tREGION\tTAGS\tPARENT")
+	for _, i := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Stack, i.Type, i.Name, i.ID, i.Label, i.Region, strings.Join(i.Tags, ","), i.Parent)
+	}
+
+	return w.Flush()
+}
+
+func writeInventoryCsv(items []inventoryItem) error {
+	w := csv.NewWriter(os.Stdout)
+	_ = w.Write([]string{"stack", "type", "name", "id", "label", "region", "tags", "parent"})
+	for _, i := range items {
+		_ = w.Write([]string{i.Stack, i.Type, i.Name, i.ID, i.Label, i.Region, strings.Join(i.Tags, ";"), i.Parent})
+	}
+	w.Flush()
+
+	return w.Error()
+}
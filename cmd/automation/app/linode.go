@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const linodeApi = "https://api.linode.com/v4"
+
+type linodeClient struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+type apiError struct {
+	path   string
+	status int
+	reason string
+}
+
+type linodeError struct {
+	Errors []struct {
+		Field  string `json:"field"`
+		Reason string `json:"reason"`
+	} `json:"errors"`
+}
+
+// newLinodeClient uses LINODE_TOKEN, and LINODE_URL when pointing at another api endpoint
+func newLinodeClient() *linodeClient {
+	url := os.Getenv("LINODE_URL")
+	if url == "" {
+		url = linodeApi
+	}
+
+	return &linodeClient{
+		url:   strings.TrimRight(url, "/"),
+		token: os.Getenv("LINODE_TOKEN"),
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (e *apiError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("linode api %s: %d", e.path, e.status)
+	}
+	return fmt.Sprintf("linode api %s: %d %s", e.path, e.status, e.reason)
+}
+
+func isNotFound(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == http.StatusNotFound
+}
+
+func (c *linodeClient) get(ctx context.Context, path string, out any) error {
+	return c.do(ctx, http.MethodGet, path, out)
+}
+
+func (c *linodeClient) post(ctx context.Context, path string, out any) error {
+	return c.do(ctx, http.MethodPost, path, out)
+}
+
+func (c *linodeClient) delete(ctx context.Context, path string) error {
+	return c.do(ctx, http.MethodDelete, path, nil)
+}
+
+func (c *linodeClient) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 300 {
+		e := &apiError{path: path, status: res.StatusCode}
+		var le linodeError
+		if json.Unmarshal(body, &le) == nil && len(le.Errors) > 0 {
+			e.reason = le.Errors[0].Reason
+		}
+		return e
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+// list follows the pages of a collection endpoint, and returns the items of all pages
+func list[T any](ctx context.Context, c *linodeClient, path string) ([]T, error) {
+	var items []T
+
+	for page := 1; ; page++ {
+		var res struct {
+			Data  []T `json:"data"`
+			Page  int `json:"page"`
+			Pages int `json:"pages"`
+		}
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		err := c.get(ctx, fmt.Sprintf("%s%spage=%d&page_size=500", path, sep, page), &res)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, res.Data...)
+		if res.Page >= res.Pages {
+			return items, nil
+		}
+	}
+}
@@ -4,176 +4,595 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 )
 
 type clicmd struct {
 	action     bool
 	name       string
-	subcommand string
+	selected   []string
 	stacks     stackMap
+	tui        bool
+	addr       string
+	workers    int
+	repo       string
+	ref        string
+	statusFile string
+	interval   time.Duration
+	once       bool
+
+	// config subcommands
+	op          string
+	target      string
+	args        []string
+	secret      bool
+	showSecrets bool
+
+	// import
+	domain  string
+	cluster string
+	tag     string
+	dryRun  bool
+
+	// sweep
+	region string
+	yes    bool
+
+	// inventory
+	output string
+
+	// create and destroy
+	breakGlass string
+	approvals  string
+
+	// upgrade
+	version     string
+	poolTimeout time.Duration
+
+	// approve
+	approver      string
+	signingKey    string
+	signatureFile string
+	policySet     string
+	policyUnset   string
+
+	// destroy
+	skipDrain bool
+	drain     drainOptions
 }
 
 func (c *clicmd) Doit(ctx context.Context) {
-	doit(ctx, c)
+	initTracing(ctx)
+
+	// long running commands start a root span per job or check instead
+	switch c.name {
+	case "serve", "reconcile", "drift":
+	default:
+		ctx = rootSpan(ctx, c.name)
+	}
+
+	switch c.name {
+	case "doctor":
+		doctor(ctx, c)
+	case "config":
+		configCmd(ctx, c)
+	case "import":
+		importResources(ctx, c)
+	case "sweep":
+		sweep(ctx, c)
+	case "inventory":
+		inventory(ctx, c)
+	case "approve":
+		approve(ctx, c)
+	case "upgrade":
+		upgrade(ctx, c)
+	case "serve":
+		serve(ctx, c)
+	case "reconcile":
+		reconcile(ctx, c)
+	case "drift":
+		drift(ctx, c)
+	default:
+		doit(ctx, c)
+	}
+}
+
+// targets returns the selected microStacks in deploy order, or all of them when none are selected
+func (c *clicmd) targets() []microStack {
+	var stks []microStack
+	for _, name := range deployOrder {
+		stk, ok := c.stacks[name]
+		if !ok {
+			continue
+		}
+		if len(c.selected) == 0 || slices.Contains(c.selected, name) {
+			stks = append(stks, stk)
+		}
+	}
+
+	return stks
+}
+
+// stackNames lists the microStacks in deploy order, for validation and completion
+func (m stackMap) stackNames() []string {
+	names := make([]string, 0, len(m))
+	for _, name := range deployOrder {
+		if _, ok := m[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	return names
 }
 
 func Init(ctx context.Context, stks stackMap, args []string) *clicmd {
-	cmd := &clicmd{
-		subcommand: "all",
-		stacks:     stks,
+	cmd := &clicmd{stacks: stks}
+
+	root := newCommand(cmd)
+	root.SetArgs(args[1:])
+	if err := root.ExecuteContext(ctx); err != nil {
+		msg("invalid", "", err)
+	}
+
+	// help and completion have nothing left to run
+	if cmd.name == "" {
+		exit(0)
 	}
 
-	if len(args) == 1 {
-		cmd.name = args[0]
-		println(Usage(cmd))
-		os.Exit(0)
+	return cmd
+}
+
+// newCommand builds the command tree, each command only records what to do in cmd
+func newCommand(cmd *clicmd) *cobra.Command {
+	root := &cobra.Command{
+		Use:           prog,
+		Short:         "run without options to target all stacks, or provide specific stack names",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		CompletionOptions: cobra.CompletionOptions{
+			DisableDefaultCmd: true,
+		},
 	}
+	root.SetHelpFunc(func(c *cobra.Command, _ []string) {
+		fmt.Println(Usage(c))
+	})
+	root.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		fmt.Println(Usage(c))
+		return err
+	})
 
-	if len(args) > 1 {
-		switch args[1] {
-		case "create":
-			cmd.action = true
-		case "destroy":
-			cmd.action = false
-		default:
-			println(Usage(cmd))
-			os.Exit(0)
+	run := func(name string) func(*cobra.Command, []string) error {
+		return func(c *cobra.Command, _ []string) error {
+			for _, k := range cmd.selected {
+				if _, ok := cmd.stacks[k]; !ok {
+					return fmt.Errorf("unknown stack %q, expected one of %s", k, strings.Join(cmd.stacks.stackNames(), ", "))
+				}
+			}
+			if name == "destroy" && cmd.drain.timeout <= 0 {
+				return fmt.Errorf("--drain-timeout must be more than 0, use --skip-drain to destroy without draining")
+			}
+			if (name == "drift" || name == "reconcile" && !cmd.once) && cmd.interval <= 0 {
+				return fmt.Errorf("--interval must be more than 0")
+			}
+			cmd.name = name
+			cmd.action = name == "create"
+			return nil
 		}
 	}
 
-	cmd.name = args[1]
-	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
-	fs.Usage = func() {
-		usage := Usage(cmd)
-		fmt.Println(usage)
-		os.Exit(0)
+	newSub := func(name, desc string) *cobra.Command {
+		c := &cobra.Command{
+			Use:   name,
+			Short: desc,
+			Args:  cobra.NoArgs,
+			RunE:  run(name),
+		}
+		root.AddCommand(c)
+		return c
 	}
 
-	for k := range stks {
-		short := k[:1]
-		fs.BoolP(k, short, false, Usage(cmd))
-		fs.Lookup(k).NoOptDefVal = "true"
+	// --stack selects microStacks, and --<name> is kept as a shorthand for one of them
+	stackFlags := func(c *cobra.Command) {
+		fs := c.Flags()
+		fs.StringArrayVarP(&cmd.selected, "stack", "s", nil, "stack to target, repeat for several, defaults to all")
+		_ = c.RegisterFlagCompletionFunc("stack", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+			return cmd.stacks.stackNames(), cobra.ShellCompDirectiveNoFileComp
+		})
+		for _, k := range cmd.stacks.stackNames() {
+			fs.AddFlag(&flag.Flag{
+				Name:        k,
+				Shorthand:   k[:1],
+				Usage:       "same as --stack " + k,
+				Value:       &stackValue{name: k, selected: &cmd.selected},
+				NoOptDefVal: "true",
+			})
+		}
 	}
 
-	_ = fs.Parse(args[1:])
+	create := newSub("create", "deploy the selected stacks in dependency order, or all of them")
+	stackFlags(create)
+	create.Flags().BoolVarP(&cmd.tui, "tui", "t", false, "live dashboard for create and destroy")
+	create.Flags().StringVar(&cmd.breakGlass, "break-glass", "", "reason to change a stack outside its maintenance windows")
+	create.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of protected environments")
+
+	destroy := newSub("destroy", "destroy the selected stacks in reverse dependency order, or everything")
+	stackFlags(destroy)
+	destroy.Flags().BoolVarP(&cmd.tui, "tui", "t", false, "live dashboard for create and destroy")
+	destroy.Flags().StringVar(&cmd.breakGlass, "break-glass", "", "reason to change a stack outside its maintenance windows")
+	destroy.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of protected environments")
+	destroy.Flags().BoolVar(&cmd.drain.keepPreserved, "keep-preserved", false, "keep preserved loadbalancer services and retained pvcs when draining")
+	destroy.Flags().DurationVar(&cmd.drain.timeout, "drain-timeout", 10*time.Minute, "time to wait for nodebalancers and volumes to be released")
+	destroy.Flags().BoolVar(&cmd.skipDrain, "skip-drain", false, "destroy the infra stack without draining the cluster first")
+
+	doctor := newSub("doctor", "check tools, tokens, stack config, dns and region before deploying")
+	stackFlags(doctor)
+
+	serve := newSub("serve", "serve an http api to create and destroy platforms by label")
+	serve.Flags().StringVar(&cmd.addr, "addr", "127.0.0.1:8080", "listen address, other than loopback requires APLCLI_API_TOKEN")
+	serve.Flags().IntVar(&cmd.workers, "workers", 2, "number of jobs to run at once")
+	serve.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of protected environments")
+
+	rec := newSub("reconcile", "preview and deploy the platform definitions that changed in a git repo")
+	rec.Flags().StringVar(&cmd.repo, "repo", "", "path or git url of the platform definitions")
+	rec.Flags().StringVar(&cmd.ref, "ref", "", "branch or ref to follow, defaults to HEAD")
+	rec.Flags().StringVar(&cmd.statusFile, "status", "reconcile-status.json", "status file")
+	rec.Flags().DurationVar(&cmd.interval, "interval", 5*time.Minute, "time between checks")
+	rec.Flags().BoolVar(&cmd.once, "once", false, "reconcile once and exit")
+	rec.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of protected environments")
+
+	drift := newSub("drift", "check stacks for drift on an interval, and serve prometheus metrics")
+	stackFlags(drift)
+	drift.Flags().StringVar(&cmd.addr, "addr", ":9090", "metrics listen address")
+	drift.Flags().DurationVar(&cmd.interval, "interval", time.Hour, "time between checks")
+
+	imp := newSub("import", "adopt an existing dns zone, lke cluster and buckets into the infra stack")
+	imp.Flags().StringVar(&cmd.domain, "domain", "", "dns zone to adopt, defaults to apl:domain")
+	imp.Flags().StringVar(&cmd.cluster, "cluster", "", "label of the lke cluster to adopt, defaults to apl:label")
+	imp.Flags().StringVar(&cmd.tag, "tag", "", "find the zone and cluster by tag when no name or label is set")
+	imp.Flags().BoolVar(&cmd.dryRun, "dry-run", false, "preview the import without changing the stack")
+
+	sw := newSub("sweep", "delete the nodebalancers, volumes and dns records that outlive a destroy")
+	sw.Flags().StringVar(&cmd.region, "region", "", "region of the platform, defaults to apl:region")
+	sw.Flags().StringVar(&cmd.domain, "domain", "", "dns zone of the external-dns records, defaults to apl:domain")
+	sw.Flags().StringVar(&cmd.cluster, "label", "", "label of the lke cluster, defaults to apl:label")
+	sw.Flags().BoolVar(&cmd.dryRun, "dry-run", false, "list the orphaned resources and their cost only")
+	sw.Flags().BoolVarP(&cmd.yes, "yes", "y", false, "delete without asking for confirmation")
+
+	inv := newSub("inventory", "report every resource of the stacks, for audits and chargeback")
+	stackFlags(inv)
+	inv.Flags().StringVarP(&cmd.output, "output", "o", "table", "report format, one of table, csv, json")
+	_ = inv.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"table", "csv", "json"}, cobra.ShellCompDirectiveNoFileComp))
+
+	upg := newSub("upgrade", "upgrade the kubernetes version of the cluster, and recycle its node pools")
+	upg.Flags().StringVar(&cmd.version, "version", "", "kubernetes version to upgrade to, e.g. 1.33")
+	_ = upg.MarkFlagRequired("version")
+	upg.Flags().DurationVar(&cmd.poolTimeout, "pool-timeout", 30*time.Minute, "time to wait for each node pool to be recycled")
+	upg.Flags().StringVar(&cmd.breakGlass, "break-glass", "", "reason to change a stack outside its maintenance windows")
+	upg.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of protected environments")
 
-	if fs.Parsed() {
-		for k := range stks {
-			f := fs.Lookup(k)
-			if f.Changed {
-				cmd.subcommand = k
+	appr := newSub("approve", "print the preview hash of a stack, and sign it with an ssh key for a protected environment")
+	appr.Flags().StringVarP(&cmd.target, "stack", "s", "", "stack to approve, one of "+strings.Join(cmd.stacks.stackNames(), ", "))
+	_ = appr.MarkFlagRequired("stack")
+	_ = appr.RegisterFlagCompletionFunc("stack", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return cmd.stacks.stackNames(), cobra.ShellCompDirectiveNoFileComp
+	})
+	appr.Flags().StringVar(&cmd.op, "op", "create", "operation to approve, create, destroy or config")
+	_ = appr.RegisterFlagCompletionFunc("op", cobra.FixedCompletions([]string{"create", "destroy", "config"}, cobra.ShellCompDirectiveNoFileComp))
+	appr.Flags().StringVar(&cmd.policySet, "set", "", "approve setting "+environmentConfig+" or "+approvalsConfig+", as key=value")
+	appr.Flags().StringVar(&cmd.policyUnset, "unset", "", "approve removing "+environmentConfig+" or "+approvalsConfig)
+	appr.Flags().StringVar(&cmd.version, "version", "", "approve an upgrade to this kubernetes version, see upgrade")
+	appr.Flags().StringVar(&cmd.approver, "as", "", "approver name in "+approvalsConfig)
+	appr.Flags().StringVar(&cmd.signingKey, "key", "", "ssh private key to sign the hash with ssh-keygen, age keys can't sign")
+	appr.Flags().StringVar(&cmd.signatureFile, "signature", "", "file with a signature made elsewhere, instead of --key")
+	appr.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "approvals file to add the signature to")
+
+	root.AddCommand(newConfigCommand(cmd))
+
+	root.AddCommand(&cobra.Command{
+		Use:       "completion [bash|zsh|fish]",
+		Short:     "print a shell completion script, e.g. source <(aplcli completion bash)",
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		RunE: func(c *cobra.Command, args []string) error {
+			switch args[0] {
+			case "bash":
+				return root.GenBashCompletionV2(os.Stdout, true)
+			case "zsh":
+				return root.GenZshCompletion(os.Stdout)
+			default:
+				return root.GenFishCompletion(os.Stdout, true)
 			}
+		},
+	})
+
+	return root
+}
+
+// newConfigCommand gets and sets the stack config that the programs Require
+func newConfigCommand(cmd *clicmd) *cobra.Command {
+	cfg := &cobra.Command{
+		Use:   "config",
+		Short: "get, set, remove or list the config of a stack",
+	}
+	cfg.PersistentFlags().StringVarP(&cmd.target, "stack", "s", "", "stack of the config, one of "+strings.Join(cmd.stacks.stackNames(), ", "))
+	_ = cfg.MarkPersistentFlagRequired("stack")
+	_ = cfg.RegisterFlagCompletionFunc("stack", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return cmd.stacks.stackNames(), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	// keys complete from the selected stack
+	keys := func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+		stk, ok := cmd.stacks[cmd.target]
+		if !ok || len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
 		}
+		return configKeys(stk), cobra.ShellCompDirectiveNoFileComp
+	}
 
+	newOp := func(use, desc string, args cobra.PositionalArgs) *cobra.Command {
+		op, _, _ := strings.Cut(use, " ")
+		c := &cobra.Command{
+			Use:               use,
+			Short:             desc,
+			Args:              args,
+			ValidArgsFunction: keys,
+			RunE: func(_ *cobra.Command, args []string) error {
+				cmd.name = "config"
+				cmd.op = op
+				cmd.args = args
+				return nil
+			},
+		}
+		cfg.AddCommand(c)
+		return c
 	}
 
-	return cmd
+	newOp("get <key>", "print the value of a config key", cobra.ExactArgs(1))
+	set := newOp("set <key> <value>", "set a config key, keys without a namespace are apl keys", cobra.ExactArgs(2))
+	set.Flags().BoolVar(&cmd.secret, "secret", false, "encrypt the value, passwords, age private key and token always are")
+	set.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of a change to "+environmentConfig+" or "+approvalsConfig)
+	rm := newOp("rm <key>", "remove a config key", cobra.ExactArgs(1))
+	rm.Flags().StringVar(&cmd.approvals, "approvals", approvalsFile, "signed approvals of a change to "+environmentConfig+" or "+approvalsConfig)
+	list := newOp("list", "list the config of a stack, and any required keys that are missing", cobra.NoArgs)
+	list.Flags().BoolVar(&cmd.showSecrets, "show-secrets", false, "print secret values in plaintext")
+
+	return cfg
+}
+
+// stackValue adds its stack to the selection when the boolean shorthand is set
+type stackValue struct {
+	name     string
+	selected *[]string
+}
+
+func (v *stackValue) String() string { return "false" }
+
+func (v *stackValue) Type() string { return "bool" }
+
+func (v *stackValue) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on && !slices.Contains(*v.selected, v.name) {
+		*v.selected = append(*v.selected, v.name)
+	}
+
+	return nil
 }
 
 func doit(ctx context.Context, cmd *clicmd) {
+	var dash *dashboard
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stks := cmd.targets()
+
+	// refuse before anything changes, when a stack is outside its maintenance windows
+	glass := map[string]*breakGlass{}
+	for _, stk := range stks {
+		s, err := localStack(ctx, stk)
+		if err == nil {
+			glass[stk.name], err = guardChange(ctx, s, stk, cmd.name, cmd.breakGlass)
+		}
+		if err != nil {
+			msg("invalid", "", err)
+		}
+	}
+
+	if cmd.tui {
+		// panels in deploy order
+		dash = newDashboard(cancel, stks...)
+	}
+
+	// the dashboard and tracing both consume engine events of an operation
+	streams := func(ctx context.Context, stk microStack) []chan<- events.EngineEvent {
+		var chs []chan<- events.EngineEvent
+		if dash != nil {
+			chs = append(chs, dash.events(stk))
+		}
+		if tracing {
+			chs = append(chs, traceEvents(ctx, stk))
+		}
+		return chs
+	}
+
 	up := func(stk microStack) {
-		stdout := optup.ProgressStreams(os.Stdout)
+		ctx, span := stackSpan(ctx, "stack "+stk.name, stk)
 		s := initLocalStack(ctx, stk)
-		s.Refresh(ctx)
-		msg("deploying", stk.fqsn, nil)
-		res, err := s.Up(ctx, stdout, colorUp{})
-		msg("deploy", stk.fqsn, err)
+		dash.op(stk, "refreshing")
+		refreshStack(ctx, s, stk)
+
+		// protected environments only change as approved, see aplcli approve
+		if err := checkApprovals(ctx, s, stk, "create", cmd.approvals); err != nil {
+			endSpan(span, err)
+			dash.done(stk, err)
+			msg("deploy", stk.fqsn, err)
+		}
 
+		// price the planned infra, and stop before anything is created when over budget
 		if stk.name == "infra" {
-			if nbid, ok := res.Outputs["loadbalancerId"]; ok {
-				s.SetConfig(ctx, "nodebalancer-id", auto.ConfigValue{Value: nbid.Value.(string)})
+			if err := checkBudget(ctx, s); err != nil {
+				endSpan(span, err)
+				dash.done(stk, err)
+				msg("deploy", stk.fqsn, err)
 			}
 		}
+		msg("deploying", stk.fqsn, nil)
+		dash.op(stk, "deploying")
+
+		ctx, upSpan := stackSpan(ctx, "up", stk)
+		opts := []optup.Option{colorUp{}}
+		if cmd.breakGlass != "" {
+			opts = append(opts, optup.Message("break glass: "+cmd.breakGlass))
+		}
+		if chs := streams(ctx, stk); len(chs) > 0 {
+			opts = append(opts, optup.EventStreams(chs...))
+		}
+		if dash == nil {
+			opts = append(opts, optup.ProgressStreams(os.Stdout))
+		}
 
+		_, err := stackUp(ctx, s, stk, opts...)
+		if err == nil {
+			err = glass[stk.name].record(ctx, s)
+		}
+		endSpan(upSpan, err)
+		endSpan(span, err)
+		dash.done(stk, err)
+		msg("deploy", stk.fqsn, err)
 	}
 
 	down := func(stk microStack) {
-		stdout := optdestroy.ProgressStreams(os.Stdout)
+		ctx, span := stackSpan(ctx, "stack "+stk.name, stk)
 		s := initLocalStack(ctx, stk)
 		msg("destroying", stk.fqsn, nil)
-		s.Refresh(ctx)
-		_, err := s.Destroy(ctx, stdout, colorDestroy{}, parallelism{})
-		msg("destroy", stk.fqsn, err)
+		dash.op(stk, "refreshing")
+		refreshStack(ctx, s, stk)
 
-		if stk.name == "infra" {
-			s.RemoveConfig(ctx, "nodebalancer-id")
+		if err := checkApprovals(ctx, s, stk, "destroy", cmd.approvals); err != nil {
+			endSpan(span, err)
+			dash.done(stk, err)
+			msg("destroy", stk.fqsn, err)
+		}
+
+		// release what the cluster's controllers created before the cluster goes
+		if stk.name == "infra" && !cmd.skipDrain {
+			dash.op(stk, "draining")
+			dctx, drainSpan := stackSpan(ctx, "drain", stk)
+			err := drain(dctx, s, cmd.drain)
+			endSpan(drainSpan, err)
+			if err != nil {
+				endSpan(span, err)
+				dash.done(stk, err)
+				msg("destroy", stk.fqsn, fmt.Errorf("drain: %w", err))
+			}
 		}
+		dash.op(stk, "destroying")
+
+		ctx, downSpan := stackSpan(ctx, "destroy", stk)
+		opts := []optdestroy.Option{colorDestroy{}, parallelism{}}
+		if cmd.breakGlass != "" {
+			opts = append(opts, optdestroy.Message("break glass: "+cmd.breakGlass))
+		}
+		if chs := streams(ctx, stk); len(chs) > 0 {
+			opts = append(opts, optdestroy.EventStreams(chs...))
+		}
+		if dash == nil {
+			opts = append(opts, optdestroy.ProgressStreams(os.Stdout))
+		}
+
+		err := stackDown(ctx, s, stk, opts...)
+		if err == nil {
+			err = glass[stk.name].record(ctx, s)
+		}
+		endSpan(downSpan, err)
+		endSpan(span, err)
+		dash.done(stk, err)
+		msg("destroy", stk.fqsn, err)
 	}
 
-	st, ok := cmd.stacks[cmd.subcommand]
-	action := cmd.action
-	switch action {
+	switch cmd.action {
 	case true:
-		if !ok {
-			// infra
-			stk := cmd.stacks["infra"]
+		for _, stk := range stks {
 			up(stk)
-
-			// apl
-			stk = cmd.stacks["apl"]
-			up(stk)
-		} else {
-			up(st)
 		}
 	case false: // tear down in reverse order
-		if !ok {
-			// apl
-			stk := cmd.stacks["apl"]
-			down(stk)
-
-			// infra
-			stk = cmd.stacks["infra"]
-			down(stk)
-		} else {
-			down(st)
+		for i := len(stks) - 1; i >= 0; i-- {
+			down(stks[i])
 		}
 	}
-	os.Exit(0)
+	exit(0)
 }
 
-func Usage(c *clicmd) string {
+// Usage renders the help of a command, with its subcommands and flags
+func Usage(c *cobra.Command) string {
 	var (
-		b           strings.Builder
-		cols        = "\n%-2s %-12s%s  %-10s  %s  %s\n"
-		usageCols   = "\n%-2s %-12s%s  %s  %s  %s\n"
-		createDesc  = "deploy a stack by name, or run without options to deploy them all"
-		destroyDesc = "provide a stack name to destory, or leave blank to destroy everything"
-		defaultDesc = "run without options to target all stacks, or provide a specific stack name"
-		msg         = fmt.Sprintf(usageCols, Magenta, "usage:", Grey, prog, "[ARG]  [OPTION]", Reset)
+		b         strings.Builder
+		cols      = "\n%-2s %-12s%s  %-14s  %s  %s\n"
+		usageCols = "\n%-2s %-12s%s  %s  %s  %s\n"
 	)
 
-	switch c.name {
-	case "create", "destroy":
-		var desc string
-		if c.name == "create" {
-			desc = createDesc
-		} else {
-			desc = destroyDesc
-		}
-		m := fmt.Sprintf("%s  [OPTION]", c.name)
-		msg = fmt.Sprintf(usageCols, Magenta, "usage:", Grey, prog, m, Reset)
-		msg += fmt.Sprintf(cols, Magenta, "description:", Grey, desc, "", Reset)
-	default:
-		msg += fmt.Sprintf(cols, Magenta, "description:", Grey, defaultDesc, "", Reset)
-		msg += fmt.Sprintf(cols, Magenta, "arguments:", Grey, "", "", Reset)
-		cd := fmt.Sprintf(cols, Magenta, "", Grey, "create", createDesc, Reset)
-		dd := fmt.Sprintf(cols, Magenta, "", Grey, "destroy", destroyDesc, Reset)
-		msg += strings.TrimLeft(cd, "\n")
-		msg += strings.TrimLeft(dd, "\n")
-	}
-
-	msg += fmt.Sprintf(cols, Magenta, "options:", Grey, "", "", Reset)
-	cd := fmt.Sprintf(cols, Magenta, "", Grey, "-a,  --apl", "", Reset)
-	dd := fmt.Sprintf(cols, Magenta, "", Grey, "-i,  --infra", "", Reset)
-	msg += strings.TrimLeft(cd, "\n")
-	msg += strings.TrimLeft(dd, "\n")
-	b.WriteString(msg)
-
-	return fmt.Sprintf("%v", b.String())
+	line := func(name, desc string) {
+		b.WriteString(strings.TrimLeft(fmt.Sprintf(cols, Magenta, "", Grey, name, desc, Reset), "\n"))
+	}
+
+	if c.HasAvailableSubCommands() {
+		b.WriteString(fmt.Sprintf(usageCols, Magenta, "usage:", Grey, c.CommandPath(), "[ARG]  [OPTION]", Reset))
+	} else {
+		use := c.CommandPath()
+		if c.HasParent() {
+			use = c.Parent().CommandPath() + " " + c.Use
+		}
+		b.WriteString(fmt.Sprintf(usageCols, Magenta, "usage:", Grey, use, "[OPTION]", Reset))
+	}
+	b.WriteString(fmt.Sprintf(cols, Magenta, "description:", Grey, c.Short, "", Reset))
+
+	if c.HasAvailableSubCommands() {
+		b.WriteString(fmt.Sprintf(cols, Magenta, "arguments:", Grey, "", "", Reset))
+		for _, sub := range c.Commands() {
+			if sub.IsAvailableCommand() {
+				line(sub.Name(), sub.Short)
+			}
+		}
+	}
+
+	var flags []*flag.Flag
+	visit := func(f *flag.Flag) {
+		if !f.Hidden && f.Name != "help" {
+			flags = append(flags, f)
+		}
+	}
+	c.LocalFlags().VisitAll(visit)
+	c.InheritedFlags().VisitAll(visit)
+
+	if len(flags) > 0 {
+		b.WriteString(fmt.Sprintf(cols, Magenta, "options:", Grey, "", "", Reset))
+		for _, f := range flags {
+			name := "--" + f.Name
+			if f.Shorthand != "" {
+				name = fmt.Sprintf("-%s,  --%s", f.Shorthand, f.Name)
+			}
+			desc := f.Usage
+			switch f.Value.Type() {
+			case "bool", "stringArray":
+			default:
+				if f.DefValue != "" {
+					desc += ", defaults to " + f.DefValue
+				}
+			}
+			line(name, desc)
+		}
+	}
+
+	return b.String()
 }
@@ -0,0 +1,424 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// platform definitions in the reconciled repository:
+//
+//	<label>/platform.yaml  config for every microStack of the platform
+//	<label>/<stack>.yaml   config for one microStack, e.g. infra.yaml
+//	<label>/values/*.yaml  helm values overlays for the apl chart
+const (
+	platformFile = "platform.yaml"
+	valuesDir    = "values"
+)
+
+type reconcileStatus struct {
+	Commit     string                       `json:"commit"`
+	Reconciled time.Time                    `json:"reconciled"`
+	Attempt    string                       `json:"attempt"`
+	Result     string                       `json:"result"`
+	Platforms  map[string]map[string]string `json:"platforms,omitempty"`
+}
+
+// defsRepo is an in-memory clone of the platform definitions, fetched on every check
+type defsRepo struct {
+	url  string
+	ref  plumbing.ReferenceName
+	repo *git.Repository
+	head plumbing.ReferenceName
+}
+
+func newDefsRepo(url, ref string) *defsRepo {
+	name := plumbing.ReferenceName(ref)
+	if ref != "" && !strings.HasPrefix(ref, "refs/") {
+		name = plumbing.NewBranchReferenceName(ref)
+	}
+	return &defsRepo{url: url, ref: name}
+}
+
+// commit clones the repository the first time, and later fetches the followed ref, then
+// returns the commit it points to. Definitions are read from git objects, so there is
+// no checkout
+func (d *defsRepo) commit(ctx context.Context) (*object.Commit, error) {
+	if d.repo == nil {
+		repo, err := git.CloneContext(ctx, memory.NewStorage(), nil, &git.CloneOptions{
+			URL:           d.url,
+			ReferenceName: d.ref,
+			SingleBranch:  d.ref != "",
+			NoCheckout:    true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone %s: %w", d.url, err)
+		}
+		head, err := repo.Head()
+		if err != nil {
+			return nil, err
+		}
+		d.repo, d.head = repo, head.Name()
+	} else {
+		spec := config.RefSpec(fmt.Sprintf("+%s:%s", d.head, d.head))
+		err := d.repo.FetchContext(ctx, &git.FetchOptions{
+			RefSpecs: []config.RefSpec{spec},
+			Force:    true,
+			Tags:     git.NoTags,
+		})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil, fmt.Errorf("failed to fetch %s: %w", d.url, err)
+		}
+	}
+
+	ref, err := d.repo.Reference(d.head, true)
+	if err != nil {
+		return nil, err
+	}
+	return d.repo.CommitObject(ref.Hash())
+}
+
+// changeSet maps platform labels to the microStacks that changed
+type changeSet map[string][]string
+
+func (c changeSet) add(label string, stks ...string) {
+	for _, k := range stks {
+		if !slices.Contains(c[label], k) {
+			c[label] = append(c[label], k)
+		}
+	}
+}
+
+func reconcile(ctx context.Context, cmd *clicmd) {
+	if cmd.repo == "" {
+		msg("invalid", "", fmt.Errorf("reconcile requires --repo <path-or-git-url>"))
+	}
+
+	defs := newDefsRepo(cmd.repo, cmd.ref)
+	for {
+		rctx, span := tracer.Start(ctx, prog+" reconcile", trace.WithNewRoot())
+		err := reconcileOnce(rctx, cmd, defs)
+		endSpan(span, err)
+		if err != nil {
+			fmt.Fprintf(stdout, "\n%s%-10s %s reconcile failed: %v %s\n", Red, "[error]", Grey, err, Reset)
+		}
+
+		if cmd.once {
+			if err != nil {
+				exit(1)
+			}
+			exit(0)
+		}
+		time.Sleep(cmd.interval)
+	}
+}
+
+func reconcileOnce(ctx context.Context, cmd *clicmd, defs *defsRepo) error {
+	status := readStatus(cmd.statusFile)
+
+	commit, err := defs.commit(ctx)
+	if err != nil {
+		return err
+	}
+	if commit.Hash.String() == status.Commit {
+		fmt.Fprintf(stdout, "\n%s%-10s %s up to date at %s %s\n", Green, "[info]", Grey, status.Commit[:8], Reset)
+		return nil
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	changes, err := changedStacks(defs.repo, status.Commit, tree)
+	if err != nil {
+		return err
+	}
+
+	status.Attempt = commit.Hash.String()
+	status.Result = "succeeded"
+	status.Platforms = map[string]map[string]string{}
+
+	labels := make([]string, 0, len(changes))
+	for label := range changes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		status.Platforms[label] = map[string]string{}
+		err := reconcilePlatform(ctx, cmd.stacks, tree, label, changes[label], status.Platforms[label], cmd.approvals)
+		if err != nil {
+			status.Result = "failed"
+			fmt.Fprintf(stdout, "\n%s%-10s %s platform %s: %v %s\n", Red, "[error]", Grey, label, err, Reset)
+		}
+	}
+
+	// only advance the reconciled commit when everything applied, so failures are retried
+	if status.Result == "succeeded" {
+		status.Commit = status.Attempt
+		status.Reconciled = time.Now().UTC()
+	}
+
+	if err := writeStatus(cmd.statusFile, status); err != nil {
+		return err
+	}
+	if status.Result != "succeeded" {
+		return fmt.Errorf("commit %s did not fully reconcile", status.Attempt[:8])
+	}
+
+	fmt.Fprintf(stdout, "\n%s%-10s %s reconciled %s %s\n", Green, "[info]", Grey, status.Commit[:8], Reset)
+	return nil
+}
+
+// changedStacks diffs the last reconciled commit against head, or returns every
+// platform when there is nothing to diff against
+func changedStacks(repo *git.Repository, last string, tree *object.Tree) (changeSet, error) {
+	changes := changeSet{}
+
+	var prev *object.Tree
+	if last != "" {
+		if c, err := repo.CommitObject(plumbing.NewHash(last)); err == nil {
+			prev, _ = c.Tree()
+		}
+	}
+
+	if prev == nil {
+		for _, e := range tree.Entries {
+			if _, err := tree.File(path.Join(e.Name, platformFile)); err == nil {
+				changes.add(e.Name, deployOrder...)
+			}
+		}
+		return changes, nil
+	}
+
+	diff, err := object.DiffTree(prev, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range diff {
+		for _, name := range []string{d.From.Name, d.To.Name} {
+			label, rest, ok := strings.Cut(name, "/")
+			if !ok {
+				continue
+			}
+
+			// removed platforms are not destroyed by reconcile
+			if _, err := tree.File(path.Join(label, platformFile)); err != nil {
+				continue
+			}
+
+			switch {
+			case rest == platformFile:
+				changes.add(label, deployOrder...)
+			case strings.HasPrefix(rest, valuesDir+"/"):
+				changes.add(label, "apl")
+			case slices.Contains(deployOrder, strings.TrimSuffix(rest, ".yaml")):
+				changes.add(label, strings.TrimSuffix(rest, ".yaml"))
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func reconcilePlatform(ctx context.Context, stacks stackMap, tree *object.Tree, label string, changed []string, result map[string]string, approvals string) error {
+	stks := stacks.platform(label)
+
+	for _, name := range deployOrder {
+		if !slices.Contains(changed, name) {
+			continue
+		}
+		result[name] = "failed"
+		err := reconcileStack(ctx, stacks, stks, tree, label, name, approvals)
+		if err != nil {
+			return err
+		}
+		result[name] = "succeeded"
+	}
+
+	return nil
+}
+
+func reconcileStack(ctx context.Context, stacks, stks stackMap, tree *object.Tree, label, name, approvals string) (err error) {
+	stk := stks[name]
+	ctx, span := stackSpan(ctx, "stack "+name, stk)
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := platformConfig(tree, label, name)
+	if err != nil {
+		return err
+	}
+
+	s, err := localStack(ctx, stk)
+	if err != nil {
+		return fmt.Errorf("failed to get local stack %s: %w", stk.fqsn, err)
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s using stack: %s %s\n", Green, "[info]", Grey, stk.fqsn, Reset)
+
+	// the definitions can't change the policy of a protected stack without its approvers
+	for _, k := range policyConfig {
+		if v, ok := cfg[k]; ok {
+			if err := checkPolicyChange(ctx, s, stk, policyChange{key: k, to: v}, approvals); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = configurePlatform(ctx, s, stacks[name], stks, platformRequest{Label: label, Config: cfg})
+	if err != nil {
+		return fmt.Errorf("failed to configure stack %s: %w", stk.fqsn, err)
+	}
+
+	// refused changes are retried with the commit on the next check
+	if _, err := guardChange(ctx, s, stk, "deploy", ""); err != nil {
+		return err
+	}
+
+	refreshStack(ctx, s, stk)
+	if err := checkApprovals(ctx, s, stk, "create", approvals); err != nil {
+		return err
+	}
+	if name == "infra" {
+		if err := checkBudget(ctx, s); err != nil {
+			return fmt.Errorf("failed to deploy stack %s: %w", stk.fqsn, err)
+		}
+	}
+
+	pctx, pspan := stackSpan(ctx, "preview", stk)
+	_, err = s.Preview(pctx, optpreview.ProgressStreams(stdout), optpreview.Color("always"))
+	endSpan(pspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to preview stack %s: %w", stk.fqsn, err)
+	}
+
+	msg("deploying", stk.fqsn, nil)
+	uctx, uspan := stackSpan(ctx, "up", stk)
+	opts := []optup.Option{optup.ProgressStreams(stdout), colorUp{}}
+	if tracing {
+		opts = append(opts, optup.EventStreams(traceEvents(uctx, stk)))
+	}
+	_, err = stackUp(uctx, s, stk, opts...)
+	endSpan(uspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to deploy stack %s: %w", stk.fqsn, err)
+	}
+
+	return nil
+}
+
+// platformConfig merges platform.yaml and <stack>.yaml, and adds the values
+// overlays to the apl stack
+func platformConfig(tree *object.Tree, label, name string) (map[string]string, error) {
+	cfg := map[string]string{}
+
+	for _, file := range []string{platformFile, name + ".yaml"} {
+		f, err := tree.File(path.Join(label, file))
+		if err != nil {
+			continue
+		}
+
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+
+		var values map[string]any
+		if err := yaml.Unmarshal([]byte(contents), &values); err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", label, file, err)
+		}
+
+		for k, v := range values {
+			// keys without a namespace belong to the apl programs
+			if !strings.Contains(k, ":") {
+				k = "apl:" + k
+			}
+			cfg[k], err = configString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %s: %w", label, file, k, err)
+			}
+		}
+	}
+
+	if name != "apl" {
+		return cfg, nil
+	}
+
+	var overlays []string
+	if dir, err := tree.Tree(path.Join(label, valuesDir)); err == nil {
+		for _, e := range dir.Entries {
+			if !strings.HasSuffix(e.Name, ".yaml") {
+				continue
+			}
+			f, err := dir.File(e.Name)
+			if err != nil {
+				return nil, err
+			}
+			contents, err := f.Contents()
+			if err != nil {
+				return nil, err
+			}
+			overlays = append(overlays, contents)
+		}
+	}
+
+	b, err := json.Marshal(overlays)
+	if err != nil {
+		return nil, err
+	}
+	cfg["apl:valuesOverlays"] = string(b)
+
+	return cfg, nil
+}
+
+// configString keeps scalars as they are, and passes structured values as json
+func configString(v any) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case map[string]any, []any:
+		b, err := json.Marshal(t)
+		return string(b), err
+	default:
+		return fmt.Sprint(t), nil
+	}
+}
+
+func readStatus(file string) reconcileStatus {
+	var status reconcileStatus
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return status
+	}
+	_ = json.Unmarshal(b, &status)
+
+	return status
+}
+
+func writeStatus(file string, status reconcileStatus) error {
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, append(b, '\n'), 0644)
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// defsRemote is a bare repository of platform definitions, and a work repository that
+// pushes commits to it
+type defsRemote struct {
+	t    *testing.T
+	bare string
+	dir  string
+	work *git.Repository
+}
+
+func newDefsRemote(t *testing.T) *defsRemote {
+	t.Helper()
+	bare := filepath.Join(t.TempDir(), "defs.git")
+	if _, err := git.PlainInit(bare, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	work, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = work.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bare}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &defsRemote{t: t, bare: bare, dir: dir, work: work}
+}
+
+// commit writes the files, commits and pushes them, and returns the commit hash
+func (r *defsRemote) commit(files map[string]string) string {
+	r.t.Helper()
+	wt, err := r.work.Worktree()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	for name, contents := range files {
+		file := filepath.Join(r.dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+
+	hash, err := wt.Commit("update definitions", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := r.work.Push(&git.PushOptions{RemoteName: "origin"}); err != nil {
+		r.t.Fatal(err)
+	}
+
+	return hash.String()
+}
+
+func (r *defsRemote) changes(defs *defsRepo, last string) changeSet {
+	r.t.Helper()
+	commit, err := defs.commit(context.Background())
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	changes, err := changedStacks(defs.repo, last, tree)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	return changes
+}
+
+func TestChangedStacks(t *testing.T) {
+	remote := newDefsRemote(t)
+	first := remote.commit(map[string]string{
+		"README.md":                  "platform definitions\n",
+		"team-a/platform.yaml":       "domain: team-a.example.com\n",
+		"team-b/platform.yaml":       "domain: team-b.example.com\n",
+		"team-b/infra.yaml":          "region: us-ord\n",
+		"not-a-platform/values.yaml": "key: value\n",
+	})
+
+	defs := newDefsRepo(remote.bare, "")
+
+	// without a reconciled commit, every platform is deployed
+	got := remote.changes(defs, "")
+	want := changeSet{"team-a": deployOrder, "team-b": deployOrder}
+	if !equalChanges(got, want) {
+		t.Fatalf("first commit: got %v, want %v", got, want)
+	}
+
+	// the same clone is fetched for the next commit
+	remote.commit(map[string]string{
+		"team-a/values/ingress.yaml": "replicas: 2\n",
+		"team-b/infra.yaml":          "region: us-sea\n",
+	})
+	got = remote.changes(defs, first)
+	want = changeSet{"team-a": {"apl"}, "team-b": {"infra"}}
+	if !equalChanges(got, want) {
+		t.Fatalf("second commit: got %v, want %v", got, want)
+	}
+}
+
+func TestReconcileStatus(t *testing.T) {
+	out := stdout
+	stdout = io.Discard
+	t.Cleanup(func() { stdout = out })
+	remote := newDefsRemote(t)
+	first := remote.commit(map[string]string{"README.md": "no platforms yet\n"})
+
+	cmd := &clicmd{statusFile: filepath.Join(t.TempDir(), "status.json")}
+	defs := newDefsRepo(remote.bare, "")
+
+	// a commit without platform changes reconciles without touching any stack
+	if err := reconcileOnce(context.Background(), cmd, defs); err != nil {
+		t.Fatal(err)
+	}
+	status := readStatus(cmd.statusFile)
+	if status.Commit != first || status.Attempt != first || status.Result != "succeeded" {
+		t.Fatalf("got status %+v, want commit %s succeeded", status, first)
+	}
+	if status.Reconciled.IsZero() {
+		t.Fatal("reconciled time is not set")
+	}
+
+	second := remote.commit(map[string]string{"README.md": "still no platforms\n"})
+	if err := reconcileOnce(context.Background(), cmd, defs); err != nil {
+		t.Fatal(err)
+	}
+	if status = readStatus(cmd.statusFile); status.Commit != second {
+		t.Fatalf("got commit %s, want %s", status.Commit, second)
+	}
+}
+
+func equalChanges(got, want changeSet) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for label, stks := range want {
+		g := slices.Clone(got[label])
+		w := slices.Clone(stks)
+		slices.Sort(g)
+		slices.Sort(w)
+		if !slices.Equal(g, w) {
+			return false
+		}
+	}
+
+	return true
+}
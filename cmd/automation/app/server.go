@@ -0,0 +1,719 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var labelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+const (
+	// maxRequestBytes limits the body of a platform request
+	maxRequestBytes = 1 << 20
+	// maxJobs and maxEvents bound the history the server keeps per platform
+	maxJobs   = 20
+	maxEvents = 10000
+	// maxQueued bounds the jobs waiting for a worker, across platforms
+	maxQueued = 100
+)
+
+// protectedConfig can't be set through the api, it holds credentials, or the change
+// policy that protects the stack, or is set by the server itself
+var protectedConfig = []string{
+	"linode:token",
+	"linode:url",
+	"linode:apiVersion",
+	"apl:label",
+	"apl:infraSlug",
+	environmentConfig,
+	windowsConfig,
+	freezesConfig,
+	approvalsConfig,
+	managedConfig,
+}
+
+type platformRequest struct {
+	Label        string            `json:"label"`
+	Stacks       []string          `json:"stacks,omitempty"`
+	Config       map[string]string `json:"config,omitempty"`
+	Environments []string          `json:"environments,omitempty"`
+}
+
+type job struct {
+	Id       string          `json:"id"`
+	Label    string          `json:"label"`
+	Action   string          `json:"action"`
+	Stacks   []string        `json:"stacks"`
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	req      platformRequest `json:"-"`
+}
+
+type platformStatus struct {
+	Label   string                    `json:"label"`
+	Status  string                    `json:"status"`
+	Jobs    []job                     `json:"jobs"`
+	Outputs map[string]map[string]any `json:"outputs,omitempty"`
+}
+
+// platformState holds the jobs of one platform. Its pending jobs wait in arrival order, and
+// the platform is in the queue of the server at most once, so one worker runs them in turn
+type platformState struct {
+	jobs      []*job
+	pending   []*job
+	scheduled bool
+	log       *eventLog
+}
+
+type server struct {
+	stacks    stackMap
+	queue     chan *platformState
+	queued    int
+	token     string
+	approvals string
+	mu        sync.Mutex
+	platforms map[string]*platformState
+
+	// runJob runs a job in the stacks of its platform, srv.run unless a test replaces it
+	runJob func(context.Context, *job, *eventLog) error
+}
+
+// eventLog keeps the engine events of a platform and fans them out to subscribers. The
+// stream of a subscriber ends when no job of the platform is queued or running
+type eventLog struct {
+	mu     sync.Mutex
+	events [][]byte
+	subs   map[chan []byte]struct{}
+	active int
+}
+
+func serve(ctx context.Context, cmd *clicmd) {
+	token := os.Getenv("APLCLI_API_TOKEN")
+	if token == "" && !loopbackAddr(cmd.addr) {
+		msg("invalid", "", fmt.Errorf("refusing to serve on %s without APLCLI_API_TOKEN, set a token or listen on 127.0.0.1", cmd.addr))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := newServer(cmd.stacks, token, cmd.approvals)
+	workers := srv.startWorkers(ctx, cmd.workers)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /platforms", srv.create)
+	mux.HandleFunc("DELETE /platforms/{label}", srv.destroy)
+	mux.HandleFunc("GET /platforms/{label}", srv.status)
+	mux.HandleFunc("GET /platforms/{label}/events", srv.events)
+
+	hs := &http.Server{
+		Addr:              cmd.addr,
+		Handler:           srv.auth(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		fmt.Fprintf(stdout, "\n%s%-10s %s shutting down, cancelling running jobs %s\n", Green, "[info]", Grey, Reset)
+		sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		hs.Shutdown(sctx)
+	}()
+
+	fmt.Fprintf(stdout, "\n%s%-10s %s serving platform api on %s %s\n", Green, "[info]", Grey, cmd.addr, Reset)
+	err := hs.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		msg("invalid", "", err)
+	}
+
+	// running jobs see the cancelled context, and pulumi cancels their updates
+	workers.Wait()
+	srv.cancelQueued()
+	exit(0)
+}
+
+func newServer(stacks stackMap, token, approvals string) *server {
+	srv := &server{
+		stacks:    stacks,
+		queue:     make(chan *platformState, maxQueued),
+		token:     token,
+		approvals: approvals,
+		platforms: map[string]*platformState{},
+	}
+	srv.runJob = srv.run
+
+	return srv
+}
+
+// startWorkers runs jobs until the context is cancelled, wait on the group for the running ones
+func (srv *server) startWorkers(ctx context.Context, n int) *sync.WaitGroup {
+	var workers sync.WaitGroup
+	for range n {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			srv.worker(ctx)
+		}()
+	}
+
+	return &workers
+}
+
+// loopbackAddr is true when a listen address only accepts local connections
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (srv *server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(srv.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid api token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookup returns the state of a platform the server has seen, without creating it
+func (srv *server) lookup(label string) (*platformState, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	p, ok := srv.platforms[label]
+	return p, ok
+}
+
+func (srv *server) platform(label string) *platformState {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	p, ok := srv.platforms[label]
+	if !ok {
+		p = &platformState{log: &eventLog{subs: map[chan []byte]struct{}{}}}
+		srv.platforms[label] = p
+	}
+	return p
+}
+
+func (srv *server) enqueue(w http.ResponseWriter, action string, req platformRequest) {
+	if !labelRe.MatchString(req.Label) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid platform label %q", req.Label))
+		return
+	}
+
+	if len(req.Stacks) == 0 {
+		req.Stacks = deployOrder
+	}
+	for _, k := range req.Stacks {
+		if _, ok := srv.stacks[k]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown stack %q", k))
+			return
+		}
+	}
+	if err := srv.validConfig(req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	j := &job{
+		Id:      uuid.NewString(),
+		Label:   req.Label,
+		Action:  action,
+		Stacks:  req.Stacks,
+		Status:  "queued",
+		Created: time.Now().UTC(),
+		req:     req,
+	}
+
+	p := srv.platform(req.Label)
+	p.log.begin()
+
+	srv.mu.Lock()
+	if srv.queued >= maxQueued {
+		srv.mu.Unlock()
+		p.log.end()
+		writeError(w, http.StatusServiceUnavailable, errors.New("job queue is full"))
+		return
+	}
+	p.jobs = append(p.jobs, j)
+	p.prune()
+	p.pending = append(p.pending, j)
+	srv.queued++
+	// the queue holds fewer platforms than queued jobs, so this never blocks
+	if !p.scheduled {
+		p.scheduled = true
+		srv.queue <- p
+	}
+	queued := *j
+	srv.mu.Unlock()
+
+	w.Header().Set("Location", "/platforms/"+req.Label)
+	writeJson(w, http.StatusAccepted, queued)
+}
+
+func (srv *server) create(w http.ResponseWriter, r *http.Request) {
+	var req platformRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	srv.enqueue(w, "create", req)
+}
+
+// validConfig accepts the keys that one of the requested stacks reads, except protected ones
+func (srv *server) validConfig(req platformRequest) error {
+	for k, v := range req.Config {
+		key := configKey(k)
+		if slices.Contains(protectedConfig, key) {
+			return fmt.Errorf("config %s can't be set through the api", key)
+		}
+
+		var err error
+		for _, name := range req.Stacks {
+			if err = validConfigKey(srv.stacks[name], key, "set"); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := validInfraConfig(key, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prune drops the oldest finished jobs beyond maxJobs, the caller holds srv.mu
+func (p *platformState) prune() {
+	for len(p.jobs) > maxJobs && p.jobs[0].Finished != nil {
+		p.jobs = p.jobs[1:]
+	}
+}
+
+func (srv *server) destroy(w http.ResponseWriter, r *http.Request) {
+	req := platformRequest{Label: r.PathValue("label")}
+	if s := r.URL.Query().Get("stacks"); s != "" {
+		req.Stacks = strings.Split(s, ",")
+	}
+	srv.enqueue(w, "destroy", req)
+}
+
+func (srv *server) status(w http.ResponseWriter, r *http.Request) {
+	label := r.PathValue("label")
+	res := platformStatus{Label: label, Status: "unknown", Outputs: map[string]map[string]any{}}
+
+	srv.mu.Lock()
+	if p, ok := srv.platforms[label]; ok {
+		for _, j := range p.jobs {
+			res.Jobs = append(res.Jobs, *j)
+			res.Status = j.Status
+		}
+	}
+	srv.mu.Unlock()
+
+	// outputs come from the stacks, so they survive a restart of the server
+	for name, stk := range srv.stacks.platform(label) {
+		s, err := auto.SelectStackLocalSource(r.Context(), stk.fqsn, stackDir(stk))
+		if err != nil {
+			continue
+		}
+		out, err := s.Outputs(r.Context())
+		if err != nil {
+			continue
+		}
+
+		res.Outputs[name] = map[string]any{}
+		for k, v := range out {
+			if v.Secret {
+				res.Outputs[name][k] = "[secret]"
+				continue
+			}
+			res.Outputs[name][k] = v.Value
+		}
+	}
+
+	if res.Jobs == nil && len(res.Outputs) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("platform %q not found", label))
+		return
+	}
+	writeJson(w, http.StatusOK, res)
+}
+
+// events streams engine events of the platform as server-sent events
+func (srv *server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	p, ok := srv.lookup(r.PathValue("label"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("platform %q not found", r.PathValue("label")))
+		return
+	}
+	backlog, ch := p.log.subscribe()
+	defer p.log.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range backlog {
+		fmt.Fprintf(w, "data: %s\n\n", e)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				// no job is left, the stream ends
+				fmt.Fprint(w, "event: done\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", e)
+			flusher.Flush()
+		}
+	}
+}
+
+// worker takes a platform from the queue and runs its oldest pending job. The platform goes
+// back to the end of the queue while jobs are left, so a busy platform never holds a worker
+func (srv *server) worker(ctx context.Context) {
+	for {
+		var p *platformState
+		select {
+		case <-ctx.Done():
+			return
+		case p = <-srv.queue:
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		j := srv.start(p)
+		p.log.reset()
+		jctx, span := tracer.Start(ctx, prog+" serve "+j.Action, trace.WithNewRoot(), trace.WithAttributes(
+			attribute.String("aplcli.platform", j.Label),
+			attribute.String("aplcli.job", j.Id),
+		))
+		err := srv.runJob(jctx, j, p.log)
+		endSpan(span, err)
+		srv.finish(j, err)
+		p.log.end()
+		srv.reschedule(p)
+	}
+}
+
+// start takes the oldest pending job of a platform
+func (srv *server) start(p *platformState) *job {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	j := p.pending[0]
+	p.pending = p.pending[1:]
+	srv.queued--
+
+	now := time.Now().UTC()
+	j.Status = "running"
+	j.Started = &now
+	return j
+}
+
+// reschedule queues the platform again when jobs are left, after its job finished
+func (srv *server) reschedule(p *platformState) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if len(p.pending) == 0 {
+		p.scheduled = false
+		return
+	}
+	srv.queue <- p
+}
+
+// cancelQueued marks the jobs that no worker started before the shutdown as cancelled
+func (srv *server) cancelQueued() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, p := range srv.platforms {
+		for _, j := range p.pending {
+			j.Status = "cancelled"
+			j.Error = "the server shut down before the job started"
+			j.Finished = &now
+			srv.queued--
+			p.log.end()
+		}
+		p.pending = nil
+	}
+}
+
+func (srv *server) finish(j *job, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now().UTC()
+	j.Finished = &now
+	j.Status = "succeeded"
+	if err != nil {
+		j.Status = "failed"
+		j.Error = err.Error()
+	}
+}
+
+// run is the same orchestration as doit, in the stacks of the job's platform
+func (srv *server) run(ctx context.Context, j *job, log *eventLog) error {
+	stks := srv.stacks.platform(j.Label)
+
+	order := slices.Clone(deployOrder)
+	if j.Action == "destroy" {
+		slices.Reverse(order)
+	}
+
+	for _, name := range order {
+		if !slices.Contains(j.Stacks, name) {
+			continue
+		}
+		err := srv.runStack(ctx, j, stks, name, log)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (srv *server) runStack(ctx context.Context, j *job, stks stackMap, name string, log *eventLog) (err error) {
+	stk := stks[name]
+	ctx, span := stackSpan(ctx, "stack "+name, stk)
+	defer func() { endSpan(span, err) }()
+
+	s, err := localStack(ctx, stk)
+	if err != nil {
+		return fmt.Errorf("failed to get local stack %s: %w", stk.fqsn, err)
+	}
+
+	if j.Action == "create" {
+		err = configurePlatform(ctx, s, srv.stacks[name], stks, j.req)
+		if err != nil {
+			return fmt.Errorf("failed to configure stack %s: %w", stk.fqsn, err)
+		}
+	}
+
+	// the api can't break glass, so changes wait for a window
+	if _, err := guardChange(ctx, s, stk, j.Action, ""); err != nil {
+		return err
+	}
+
+	refreshStack(ctx, s, stk)
+	if err := checkApprovals(ctx, s, stk, j.Action, srv.approvals); err != nil {
+		return err
+	}
+
+	if j.Action == "create" && name == "infra" {
+		if err := checkBudget(ctx, s); err != nil {
+			return fmt.Errorf("failed to create stack %s: %w", stk.fqsn, err)
+		}
+	}
+	if j.Action == "destroy" && name == "infra" {
+		dctx, drainSpan := stackSpan(ctx, "drain", stk)
+		err = drain(dctx, s, drainOptions{timeout: 10 * time.Minute})
+		endSpan(drainSpan, err)
+		if err != nil {
+			return fmt.Errorf("failed to drain stack %s: %w", stk.fqsn, err)
+		}
+	}
+
+	ctx, opSpan := stackSpan(ctx, j.Action, stk)
+	chs := []chan<- events.EngineEvent{log.record()}
+	if tracing {
+		chs = append(chs, traceEvents(ctx, stk))
+	}
+
+	switch j.Action {
+	case "create":
+		_, err = stackUp(ctx, s, stk, optup.EventStreams(chs...))
+	case "destroy":
+		err = stackDown(ctx, s, stk, parallelism{}, optdestroy.EventStreams(chs...))
+	}
+	endSpan(opSpan, err)
+	if err != nil {
+		return fmt.Errorf("failed to %s stack %s: %w", j.Action, stk.fqsn, err)
+	}
+
+	return nil
+}
+
+// configurePlatform points a platform stack at its label, the infra stack of the
+// same platform, and the esc environments of the default stack
+func configurePlatform(ctx context.Context, s auto.Stack, base microStack, stks stackMap, req platformRequest) error {
+	envs, err := s.ListEnvironments(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(envs) == 0 {
+		envs = req.Environments
+		if len(envs) == 0 {
+			b, err := auto.SelectStackLocalSource(ctx, base.fqsn, stackDir(base))
+			if err != nil {
+				return err
+			}
+			if envs, err = b.ListEnvironments(ctx); err != nil {
+				return err
+			}
+		}
+		if err := s.AddEnvironments(ctx, envs...); err != nil {
+			return err
+		}
+	}
+
+	cfg := auto.ConfigMap{
+		"apl:label": auto.ConfigValue{Value: req.Label},
+	}
+	if base.name == "apl" {
+		cfg["apl:infraSlug"] = auto.ConfigValue{Value: stks["infra"].fqsn}
+	}
+	// the keys were validated against the requested stacks, each stack gets its own
+	for k, v := range req.Config {
+		key := configKey(k)
+		if validConfigKey(base, key, "set") != nil {
+			continue
+		}
+		cfg[key] = auto.ConfigValue{Value: v, Secret: slices.Contains(secretConfig, key)}
+	}
+
+	return s.SetAllConfig(ctx, cfg)
+}
+
+// subscribe returns the events so far, and a channel of new ones that is closed when no
+// job is left. Without a job, the channel is closed right away
+func (l *eventLog) subscribe() ([][]byte, chan []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch := make(chan []byte, 64)
+	if l.active == 0 {
+		close(ch)
+	} else {
+		l.subs[ch] = struct{}{}
+	}
+	return slices.Clone(l.events), ch
+}
+
+// begin counts a queued job
+func (l *eventLog) begin() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active++
+}
+
+// end counts a finished job, and ends the streams after the last one
+func (l *eventLog) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if l.active > 0 {
+		return
+	}
+	for sub := range l.subs {
+		close(sub)
+		delete(l.subs, sub)
+	}
+}
+
+// reset drops the events of the previous job
+func (l *eventLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = nil
+}
+
+func (l *eventLog) unsubscribe(ch chan []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subs, ch)
+}
+
+// record returns an engine event stream for one update of the platform
+func (l *eventLog) record() chan<- events.EngineEvent {
+	ch := make(chan events.EngineEvent)
+	go func() {
+		for e := range ch {
+			b, err := json.Marshal(e.EngineEvent)
+			if err != nil {
+				continue
+			}
+
+			l.mu.Lock()
+			l.events = append(l.events, b)
+			if len(l.events) > maxEvents {
+				l.events = l.events[len(l.events)-maxEvents:]
+			}
+			for sub := range l.subs {
+				select {
+				case sub <- b:
+				default:
+					// drop events for subscribers that can't keep up
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return ch
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobRecorder stands in for the pulumi orchestration of the server, and records the jobs
+type jobRecorder struct {
+	mu      sync.Mutex
+	started []string
+	running map[string]bool
+	overlap bool
+	release chan struct{}
+}
+
+func (r *jobRecorder) run(ctx context.Context, j *job, _ *eventLog) error {
+	r.mu.Lock()
+	if r.running[j.Label] {
+		r.overlap = true
+	}
+	r.running[j.Label] = true
+	r.started = append(r.started, j.Label+" "+j.Action)
+	r.mu.Unlock()
+
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	r.running[j.Label] = false
+	r.mu.Unlock()
+	return nil
+}
+
+func testServer(t *testing.T) (*server, *jobRecorder) {
+	t.Helper()
+	stacks := stackMap{"infra": {name: "infra", fqsn: "org/infra/dev"}, "apl": {name: "apl", fqsn: "org/apl/dev"}}
+	srv := newServer(stacks, "", "")
+	rec := &jobRecorder{running: map[string]bool{}, release: make(chan struct{})}
+	srv.runJob = rec.run
+	return srv, rec
+}
+
+func submit(t *testing.T, srv *server, action, label string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.enqueue(w, action, platformRequest{Label: label})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("%s %s: got %d %s, want %d", action, label, w.Code, w.Body, http.StatusAccepted)
+	}
+}
+
+// statuses returns the status of every job of a platform, oldest first
+func statuses(srv *server, label string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var got []string
+	for _, j := range srv.platforms[label].jobs {
+		got = append(got, j.Status)
+	}
+	return got
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestServerRunsJobsOfAPlatformInOrder(t *testing.T) {
+	srv, rec := testServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// queued before the workers start, so both workers can take a job right away
+	submit(t, srv, "create", "team-a")
+	submit(t, srv, "destroy", "team-a")
+	submit(t, srv, "create", "team-b")
+	workers := srv.startWorkers(ctx, 2)
+
+	// team-b runs beside team-a, the destroy of team-a waits for its create
+	waitFor(t, "team-a and team-b to run", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.started) == 2
+	})
+	if got := statuses(srv, "team-a"); !slices.Equal(got, []string{"running", "queued"}) {
+		t.Fatalf("got team-a jobs %v, want the create running and the destroy queued", got)
+	}
+
+	for range 3 {
+		rec.release <- struct{}{}
+	}
+	waitFor(t, "the jobs to finish", func() bool {
+		return slices.Equal(statuses(srv, "team-a"), []string{"succeeded", "succeeded"})
+	})
+	cancel()
+	workers.Wait()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.overlap {
+		t.Fatal("two jobs of a platform ran at once")
+	}
+	a := slices.Index(rec.started, "team-a create")
+	d := slices.Index(rec.started, "team-a destroy")
+	if a < 0 || d < a {
+		t.Fatalf("got jobs %v, want the create of team-a before its destroy", rec.started)
+	}
+}
+
+func TestServerCancelsQueuedJobsOnShutdown(t *testing.T) {
+	srv, _ := testServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	submit(t, srv, "create", "team-a")
+	submit(t, srv, "destroy", "team-a")
+	workers := srv.startWorkers(ctx, 1)
+	waitFor(t, "the create to run", func() bool {
+		return statuses(srv, "team-a")[0] == "running"
+	})
+
+	cancel()
+	workers.Wait()
+	srv.cancelQueued()
+
+	if got := statuses(srv, "team-a"); !slices.Equal(got, []string{"succeeded", "cancelled"}) {
+		t.Fatalf("got team-a jobs %v, want the queued destroy cancelled", got)
+	}
+	if srv.queued != 0 {
+		t.Fatalf("got %d queued jobs after the shutdown, want 0", srv.queued)
+	}
+}
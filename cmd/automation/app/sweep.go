@@ -0,0 +1,283 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+)
+
+// the csi driver labels volumes after the persistent volume, e.g. pvc3f2a...
+var pvcLabel = regexp.MustCompile(`^pvc[0-9a-f]{16,}$`)
+
+// orphan is a resource a kubernetes controller created, which outlives the infra stack
+type orphan struct {
+	kind    string
+	id      int
+	label   string
+	region  string
+	monthly float64
+	path    string
+}
+
+type volume struct {
+	Id       int      `json:"id"`
+	Label    string   `json:"label"`
+	Region   string   `json:"region"`
+	Size     int      `json:"size"`
+	LinodeId *int     `json:"linode_id"`
+	Tags     []string `json:"tags"`
+}
+
+type domainRecord struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+type price struct {
+	Hourly  float64 `json:"hourly"`
+	Monthly float64 `json:"monthly"`
+}
+
+type priceType struct {
+	Id           string `json:"id"`
+	Price        price  `json:"price"`
+	RegionPrices []struct {
+		price
+		Id string `json:"id"`
+	} `json:"region_prices"`
+}
+
+// monthly is the price of a type in a region, some regions are priced differently
+func (t priceType) monthly(region string) float64 {
+	for _, p := range t.RegionPrices {
+		if p.Id == region {
+			return p.Monthly
+		}
+	}
+	return t.Price.Monthly
+}
+
+func sweep(ctx context.Context, cmd *clicmd) {
+	region, domainName, label := cmd.region, cmd.domain, cmd.cluster
+
+	// flags win over the config of the infra stack, which outlives a destroy
+	if cfg, err := stackConfig(ctx, cmd.stacks["infra"]); err == nil {
+		if region == "" {
+			region = cfg["apl:region"].Value
+		}
+		if domainName == "" {
+			domainName = cfg["apl:domain"].Value
+		}
+		if label == "" {
+			label = cfg["apl:label"].Value
+		}
+	}
+	if region == "" {
+		msg("invalid", "", fmt.Errorf("sweep requires --region, or apl:region in the infra stack"))
+	}
+	// the label tells the resources of this platform apart from others in the region
+	if label == "" {
+		msg("invalid", "", fmt.Errorf("sweep requires --label, or apl:label in the infra stack"))
+	}
+
+	c := newLinodeClient()
+
+	// controllers of a running cluster still own these resources
+	clusters, err := list[lkeCluster](ctx, c, "/lke/clusters")
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	for _, l := range clusters {
+		if l.Label == label && l.Region == region {
+			msg("invalid", "", fmt.Errorf("lke cluster %s still exists, destroy the platform before sweeping", label))
+		}
+	}
+
+	orphans, err := findOrphans(ctx, c, region, label, domainName)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	if len(orphans) == 0 {
+		fmt.Fprintf(stdout, "\n%s%-10s %s nothing to sweep in %s %s\n", Green, "[info]", Grey, region, Reset)
+		exit(0)
+	}
+
+	var total float64
+	cols := "%s%-14s %-10s %-36s %-10s %s%9s%s\n"
+	fmt.Fprintf(stdout, "\n"+cols, Magenta, "TYPE", "ID", "LABEL", "REGION", Grey, "$/MONTH", Reset)
+	for _, o := range orphans {
+		fmt.Fprintf(stdout, cols, Grey, o.kind, fmt.Sprint(o.id), o.label, o.region, "", fmt.Sprintf("%.2f", o.monthly), Reset)
+		total += o.monthly
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s %d orphaned resources cost $%.2f a month %s\n", Magenta, "[sweep]", Grey, len(orphans), total, Reset)
+
+	if cmd.dryRun {
+		exit(0)
+	}
+	if !cmd.yes && !confirm(fmt.Sprintf("delete %d resources?", len(orphans))) {
+		fmt.Fprintf(stdout, "\n%s%-10s %s nothing was deleted %s\n", Green, "[info]", Grey, Reset)
+		exit(0)
+	}
+
+	failed := 0
+	for _, o := range orphans {
+		if err := c.delete(ctx, o.path); err != nil && !isNotFound(err) {
+			failed++
+			fmt.Fprintf(stdout, "%s%-10s %s failed to delete %s %s: %v%s\n", Red, "[error]", Grey, o.kind, o.label, err, Reset)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s%-10s %s deleted %s %s %s\n", Green, "[info]", Grey, o.kind, o.label, Reset)
+	}
+	if failed > 0 {
+		msg("invalid", "", fmt.Errorf("%d of %d resources were not deleted", failed, len(orphans)))
+	}
+	exit(0)
+}
+
+// findOrphans lists the static loadbalancer nodebalancers, unattached pvc volumes,
+// and external-dns records of a platform. Nodebalancers and volumes must have its tag
+func findOrphans(ctx context.Context, c *linodeClient, region, label, domainName string) ([]orphan, error) {
+	var orphans []orphan
+
+	nbPrice, volPrice, err := prices(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	nbs, err := list[nodebalancer](ctx, c, "/nodebalancers")
+	if err != nil {
+		return nil, err
+	}
+	for _, nb := range nbs {
+		if nb.Region != region || !slices.Contains(nb.Tags, infra.NodeBalancerTag) || !slices.Contains(nb.Tags, infra.PlatformTag(label)) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:    "nodebalancer",
+			id:      nb.Id,
+			label:   nb.Label,
+			region:  nb.Region,
+			monthly: nbPrice.monthly(region),
+			path:    fmt.Sprintf("/nodebalancers/%d", nb.Id),
+		})
+	}
+
+	vols, err := list[volume](ctx, c, "/volumes")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		if v.Region != region || v.LinodeId != nil || !pvcLabel.MatchString(v.Label) || !slices.Contains(v.Tags, infra.PlatformTag(label)) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:    "volume",
+			id:      v.Id,
+			label:   v.Label,
+			region:  v.Region,
+			monthly: volPrice.monthly(region) * float64(v.Size),
+			path:    fmt.Sprintf("/volumes/%d", v.Id),
+		})
+	}
+
+	if domainName == "" {
+		return orphans, nil
+	}
+
+	// the zone is gone with the infra stack, unless it was kept or adopted elsewhere
+	d, err := findDomain(ctx, c, domainName, "")
+	if err != nil || d == nil {
+		return orphans, err
+	}
+	records, err := list[domainRecord](ctx, c, fmt.Sprintf("/domains/%d/records", d.Id))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range externalDnsRecords(records) {
+		name := r.Name
+		if name == "" {
+			name = "@"
+		}
+		orphans = append(orphans, orphan{
+			kind:   "record " + r.Type,
+			id:     r.Id,
+			label:  name + "." + d.Domain,
+			region: "-",
+			path:   fmt.Sprintf("/domains/%d/records/%d", d.Id, r.Id),
+		})
+	}
+
+	return orphans, nil
+}
+
+// externalDnsRecords returns the ownership txt records of external-dns, and the
+// records they claim, either by the same name or by a type prefix, e.g. a-www
+func externalDnsRecords(records []domainRecord) []domainRecord {
+	owned := map[string]bool{}
+	for _, r := range records {
+		if r.Type == "TXT" && strings.Contains(r.Target, "heritage=external-dns") {
+			owned[r.Name] = true
+			for _, prefix := range []string{"a-", "aaaa-", "cname-"} {
+				if name, ok := strings.CutPrefix(r.Name, prefix); ok {
+					owned[name] = true
+				}
+			}
+		}
+	}
+
+	var found []domainRecord
+	for _, r := range records {
+		switch r.Type {
+		case "TXT":
+			if strings.Contains(r.Target, "heritage=external-dns") {
+				found = append(found, r)
+			}
+		case "A", "AAAA", "CNAME":
+			if owned[r.Name] {
+				found = append(found, r)
+			}
+		}
+	}
+
+	return found
+}
+
+func prices(ctx context.Context, c *linodeClient) (nb, vol priceType, err error) {
+	nbTypes, err := list[priceType](ctx, c, "/nodebalancers/types")
+	if err != nil {
+		return nb, vol, err
+	}
+	volTypes, err := list[priceType](ctx, c, "/volumes/types")
+	if err != nil {
+		return nb, vol, err
+	}
+
+	if len(nbTypes) > 0 {
+		nb = nbTypes[0]
+	}
+	if len(volTypes) > 0 {
+		vol = volTypes[0]
+	}
+
+	return nb, vol, nil
+}
+
+func confirm(prompt string) bool {
+	fmt.Fprintf(stdout, "\n%s%-10s %s %s [y/N] %s", Magenta, "[confirm]", Grey, prompt, Reset)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// linodeStandIn serves the collections of the linode api from memory, with one page each, and
+// returns its url
+func linodeStandIn(t *testing.T, collections map[string]any) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := collections[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data, "page": 1, "pages": 1})
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("LINODE_URL", srv.URL)
+	t.Setenv("LINODE_TOKEN", "test")
+	return srv.URL
+}
+
+func TestFindOrphansOfPlatform(t *testing.T) {
+	attached := 42
+	linodeStandIn(t, map[string]any{
+		"/nodebalancers/types": []priceType{{Id: "nodebalancer", Price: price{Monthly: 10}}},
+		"/volumes/types":       []priceType{{Id: "volume", Price: price{Monthly: 0.1}}},
+		"/nodebalancers": []nodebalancer{
+			{Id: 1, Label: "ccm-ours", Region: "us-ord", Tags: []string{"apl-static-lb", "apl-platform-team-a"}},
+			{Id: 2, Label: "ccm-theirs", Region: "us-ord", Tags: []string{"apl-static-lb", "apl-platform-team-b"}},
+			{Id: 3, Label: "ccm-untagged", Region: "us-ord", Tags: []string{"apl-static-lb"}},
+			{Id: 4, Label: "ccm-elsewhere", Region: "us-sea", Tags: []string{"apl-static-lb", "apl-platform-team-a"}},
+		},
+		"/volumes": []volume{
+			{Id: 11, Label: "pvc0123456789abcdef0", Region: "us-ord", Size: 10, Tags: []string{"apl-platform-team-a"}},
+			{Id: 12, Label: "pvc0123456789abcdef1", Region: "us-ord", Size: 10, Tags: []string{"apl-platform-team-b"}},
+			{Id: 13, Label: "pvc0123456789abcdef2", Region: "us-ord", Size: 10, Tags: []string{"apl-platform-team-a"}, LinodeId: &attached},
+			{Id: 14, Label: "pvc0123456789abcdef3", Region: "us-ord", Size: 10},
+		},
+	})
+
+	orphans, err := findOrphans(context.Background(), newLinodeClient(), "us-ord", "team-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, o := range orphans {
+		got = append(got, o.path)
+	}
+	want := []string{"/nodebalancers/1", "/volumes/11"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got orphans %v, want %v", got, want)
+	}
+	if orphans[0].monthly != 10 || orphans[1].monthly != 1 {
+		t.Fatalf("got monthly %.2f and %.2f, want 10.00 and 1.00", orphans[0].monthly, orphans[1].monthly)
+	}
+}
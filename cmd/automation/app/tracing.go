@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// tracer delegates to the global provider, and is a no-op until tracing is set up
+	tracer = otel.Tracer(prog)
+
+	// tracing is set when an otlp endpoint is configured
+	tracing bool
+)
+
+// initTracing exports spans over otlp when the standard OTEL_EXPORTER_OTLP_*
+// variables point at a collector, e.g. OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318
+func initTracing(ctx context.Context) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+
+	var (
+		exp *otlptrace.Exporter
+		err error
+	)
+	switch os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL") {
+	case "grpc":
+		exp, err = otlptracegrpc.New(ctx)
+	default:
+		exp, err = otlptracehttp.New(ctx)
+	}
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(semconv.ServiceName(prog)),
+	)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	tracing = true
+
+	onExit = append(onExit, func(int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = tp.Shutdown(ctx)
+	})
+}
+
+// rootSpan starts the span of a command run, and ends it with the exit code
+func rootSpan(ctx context.Context, name string) context.Context {
+	ctx, span := tracer.Start(ctx, prog+" "+name)
+	onExit = append(onExit, func(code int) {
+		if code != 0 {
+			span.SetStatus(codes.Error, fmt.Sprintf("exit status %d", code))
+		}
+		span.End()
+	})
+
+	return ctx
+}
+
+func stackSpan(ctx context.Context, name string, stk microStack) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("pulumi.stack.fqsn", stk.fqsn),
+		attribute.String("pulumi.stack.name", stk.name),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceEvents turns the engine events of an operation into one span per resource step
+func traceEvents(ctx context.Context, stk microStack) chan<- events.EngineEvent {
+	ch := make(chan events.EngineEvent)
+	go func() {
+		spans := map[string]trace.Span{}
+		for e := range ch {
+			switch {
+			case e.ResourcePreEvent != nil:
+				md := e.ResourcePreEvent.Metadata
+				if md.Op == apitype.OpSame {
+					continue
+				}
+				_, span := tracer.Start(ctx, string(md.Op)+" "+md.Type, trace.WithAttributes(
+					attribute.String("pulumi.stack.fqsn", stk.fqsn),
+					attribute.String("pulumi.resource.type", md.Type),
+					attribute.String("pulumi.resource.urn", md.URN),
+					attribute.String("pulumi.op", string(md.Op)),
+				))
+				spans[md.URN] = span
+			case e.ResOutputsEvent != nil:
+				if span, ok := spans[e.ResOutputsEvent.Metadata.URN]; ok {
+					span.End()
+					delete(spans, e.ResOutputsEvent.Metadata.URN)
+				}
+			case e.ResOpFailedEvent != nil:
+				if span, ok := spans[e.ResOpFailedEvent.Metadata.URN]; ok {
+					span.SetStatus(codes.Error, "resource operation failed")
+					span.End()
+					delete(spans, e.ResOpFailedEvent.Metadata.URN)
+				}
+			case e.DiagnosticEvent != nil && e.DiagnosticEvent.Severity == "error":
+				if span, ok := spans[e.DiagnosticEvent.URN]; ok {
+					span.AddEvent("diagnostic", trace.WithAttributes(
+						attribute.String("message", e.DiagnosticEvent.Message),
+					))
+				}
+			}
+		}
+
+		// steps that never finished, e.g. a cancelled update
+		for _, span := range spans {
+			span.SetStatus(codes.Error, "operation did not complete")
+			span.End()
+		}
+	}()
+
+	return ch
+}
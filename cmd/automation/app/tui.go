@@ -0,0 +1,283 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-isatty"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+)
+
+const maxPanelRows = 20
+
+var (
+	panelStyle = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("5")).Padding(0, 1)
+	titleStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("5"))
+	greyStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("7"))
+	greenStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	redStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	blueStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("4"))
+)
+
+// dashboard renders one panel per microStack from the engine events of an
+// update, in place of the raw progress streams
+type dashboard struct {
+	prog *tea.Program
+	once sync.Once
+}
+
+type resourceRow struct {
+	urn, parent, typ, op, status string
+}
+
+type panel struct {
+	name, fqsn string
+	op         string
+	start, end time.Time
+	rows       []*resourceRow
+	index      map[string]*resourceRow
+	errs       []string
+}
+
+type dashModel struct {
+	order  []string
+	panels map[string]*panel
+	width  int
+}
+
+type tickMsg time.Time
+
+type opMsg struct {
+	stack, op string
+}
+
+type eventMsg struct {
+	stack string
+	event events.EngineEvent
+}
+
+type doneMsg struct {
+	stack string
+	err   error
+}
+
+// newDashboard returns nil when stdout is not a terminal, and callers fall
+// back to the plain progress streams
+func newDashboard(cancel context.CancelFunc, stks ...microStack) *dashboard {
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		return nil
+	}
+
+	m := dashModel{panels: map[string]*panel{}}
+	for _, stk := range stks {
+		m.order = append(m.order, stk.name)
+		m.panels[stk.name] = &panel{
+			name:  stk.name,
+			fqsn:  stk.fqsn,
+			op:    "waiting",
+			index: map[string]*resourceRow{},
+		}
+	}
+
+	d := &dashboard{prog: tea.NewProgram(m, tea.WithInput(nil))}
+	go func() {
+		// the dashboard only quits on its own when interrupted, so cancel running updates
+		_, _ = d.prog.Run()
+		cancel()
+	}()
+
+	stdout = d
+	onExit = append(onExit, func(int) { d.stop() })
+	return d
+}
+
+// Write prints above the dashboard panels
+func (d *dashboard) Write(b []byte) (int, error) {
+	d.prog.Println(strings.Trim(string(b), "\n"))
+	return len(b), nil
+}
+
+func (d *dashboard) op(stk microStack, op string) {
+	if d == nil {
+		return
+	}
+	d.prog.Send(opMsg{stack: stk.name, op: op})
+}
+
+func (d *dashboard) done(stk microStack, err error) {
+	if d == nil {
+		return
+	}
+	d.prog.Send(doneMsg{stack: stk.name, err: err})
+}
+
+// events forwards engine events to the stack panel until the update closes the channel
+func (d *dashboard) events(stk microStack) chan<- events.EngineEvent {
+	ch := make(chan events.EngineEvent)
+	go func() {
+		for e := range ch {
+			d.prog.Send(eventMsg{stack: stk.name, event: e})
+		}
+	}()
+	return ch
+}
+
+func (d *dashboard) stop() {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		d.prog.Quit()
+		d.prog.Wait()
+		stdout = os.Stdout
+	})
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+func (m dashModel) Init() tea.Cmd {
+	return tick()
+}
+
+func (m dashModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch v := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = v.Width
+	case tickMsg:
+		return m, tick()
+	case opMsg:
+		p := m.panels[v.stack]
+		p.op = v.op
+		if p.start.IsZero() {
+			p.start = time.Now()
+		}
+	case eventMsg:
+		m.panels[v.stack].apply(v.event)
+	case doneMsg:
+		p := m.panels[v.stack]
+		p.end = time.Now()
+		p.op = "done"
+		if v.err != nil {
+			p.op = "failed"
+			p.errs = append(p.errs, v.err.Error())
+		}
+	}
+
+	return m, nil
+}
+
+func (p *panel) apply(e events.EngineEvent) {
+	switch {
+	case e.Error != nil:
+		p.errs = append(p.errs, e.Error.Error())
+	case e.ResourcePreEvent != nil:
+		md := e.ResourcePreEvent.Metadata
+		r := p.row(md.URN)
+		r.typ = md.Type
+		r.op = string(md.Op)
+		r.status = "running"
+		if md.New != nil {
+			r.parent = md.New.Parent
+		} else if md.Old != nil {
+			r.parent = md.Old.Parent
+		}
+	case e.ResOutputsEvent != nil:
+		p.row(e.ResOutputsEvent.Metadata.URN).status = "done"
+	case e.ResOpFailedEvent != nil:
+		p.row(e.ResOpFailedEvent.Metadata.URN).status = "failed"
+	case e.DiagnosticEvent != nil && e.DiagnosticEvent.Severity == "error":
+		p.errs = append(p.errs, strings.TrimSpace(e.DiagnosticEvent.Message))
+	}
+}
+
+func (p *panel) row(urn string) *resourceRow {
+	if r, ok := p.index[urn]; ok {
+		return r
+	}
+
+	r := &resourceRow{urn: urn}
+	p.index[urn] = r
+	p.rows = append(p.rows, r)
+	return r
+}
+
+// depth counts the known parents of a resource, to indent the resource tree
+func (p *panel) depth(r *resourceRow) int {
+	d := 0
+	for parent, ok := p.index[r.parent]; ok && d < 10; parent, ok = p.index[parent.parent] {
+		d++
+	}
+	return d
+}
+
+func (p *panel) elapsed() time.Duration {
+	switch {
+	case p.start.IsZero():
+		return 0
+	case p.end.IsZero():
+		return time.Since(p.start).Round(time.Second)
+	default:
+		return p.end.Sub(p.start).Round(time.Second)
+	}
+}
+
+func (p *panel) view(width int) string {
+	var b strings.Builder
+
+	op := blueStyle.Render(p.op)
+	switch p.op {
+	case "done":
+		op = greenStyle.Render(p.op)
+	case "failed":
+		op = redStyle.Render(p.op)
+	}
+	fmt.Fprintf(&b, "%s  %s  %s  %s\n", titleStyle.Render(p.name), greyStyle.Render(p.fqsn), op, p.elapsed())
+
+	rows := p.rows
+	if len(rows) > maxPanelRows {
+		fmt.Fprintf(&b, "%s\n", greyStyle.Render(fmt.Sprintf("... %d more", len(rows)-maxPanelRows)))
+		rows = rows[len(rows)-maxPanelRows:]
+	}
+
+	for _, r := range rows {
+		mark := blueStyle.Render("~")
+		switch r.status {
+		case "done":
+			mark = greenStyle.Render("✓")
+		case "failed":
+			mark = redStyle.Render("✗")
+		}
+		name := r.urn[strings.LastIndex(r.urn, "::")+2:]
+		indent := strings.Repeat("  ", p.depth(r))
+		fmt.Fprintf(&b, "%s%s %-8s %s %s\n", indent, mark, r.op, name, greyStyle.Render(r.typ))
+	}
+
+	for _, e := range p.errs {
+		fmt.Fprintf(&b, "%s\n", redStyle.Render(e))
+	}
+
+	style := panelStyle
+	if width > 4 {
+		style = style.Width(width - 4)
+	}
+	return style.Render(strings.TrimRight(b.String(), "\n"))
+}
+
+func (m dashModel) View() string {
+	var views []string
+	for _, name := range m.order {
+		views = append(views, m.panels[name].view(m.width))
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left, views...) + "\n"
+}
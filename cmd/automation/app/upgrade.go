@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	apl "github.com/rylabs-billy/steal-this-idp/cmd/apl/app"
+	infra "github.com/rylabs-billy/steal-this-idp/cmd/infra/app"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+)
+
+const (
+	upgradePoll  = 15 * time.Second
+	firewallType = "linode:index/firewall:Firewall"
+)
+
+type lkeVersion struct {
+	Id string `json:"id"`
+}
+
+type lkePool struct {
+	Id         int               `json:"id"`
+	Type       string            `json:"type"`
+	Count      int               `json:"count"`
+	Labels     map[string]string `json:"labels"`
+	Tags       []string          `json:"tags"`
+	Taints     []infra.Taint     `json:"taints"`
+	Autoscaler struct {
+		Enabled bool `json:"enabled"`
+		Min     int  `json:"min"`
+		Max     int  `json:"max"`
+	} `json:"autoscaler"`
+	Nodes []struct {
+		Id         string `json:"id"`
+		InstanceId int    `json:"instance_id"`
+		Status     string `json:"status"`
+	} `json:"nodes"`
+}
+
+// upgrade bumps the kubernetes version of the infra stack, then recycles the node pools one
+// at a time, so every node runs the new version
+func upgrade(ctx context.Context, cmd *clicmd) {
+	stk, ok := cmd.stacks["infra"]
+	if !ok {
+		msg("invalid", "", fmt.Errorf("upgrade requires the infra stack"))
+	}
+	version := cmd.version
+
+	// refuse before anything changes
+	if !apl.SupportsK8s(version) {
+		msg("invalid", "", fmt.Errorf("apl chart %s does not support kubernetes %s, only %s", apl.ChartVersion(), version, strings.Join(apl.K8sVersions(), ", ")))
+	}
+
+	c := newLinodeClient()
+	versions, err := list[lkeVersion](ctx, c, "/lke/versions")
+	if err != nil {
+		msg("invalid", "", fmt.Errorf("failed to list lke versions: %w", err))
+	}
+	if !slices.ContainsFunc(versions, func(v lkeVersion) bool { return v.Id == version }) {
+		msg("invalid", "", fmt.Errorf("lke does not offer kubernetes %s", version))
+	}
+
+	s := initLocalStack(ctx, stk)
+	glass, err := guardChange(ctx, s, stk, "upgrade", cmd.breakGlass)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	current := infra.K8sVersion(planData(cfg))
+	if minorVersion(version) < minorVersion(current) {
+		msg("invalid", "", fmt.Errorf("refusing to downgrade kubernetes from %s to %s", current, version))
+	}
+	if version == current {
+		fmt.Fprintf(stdout, "\n%s%-10s %s %s already runs kubernetes %s %s\n", Green, "[info]", Grey, stk.fqsn, version, Reset)
+		exit(0)
+	}
+	fmt.Fprintf(stdout, "\n%s%-10s %s kubernetes %s to %s, apl chart %s %s\n", Green, "[upgrade]", Grey, current, version, apl.ChartVersion(), Reset)
+
+	// approvals are over a preview with the new version, which is only kept once lke runs it
+	restore, err := setK8sVersion(ctx, s, version)
+	if err != nil {
+		msg("invalid", "", err)
+	}
+	fail := func(err error) {
+		if rerr := restore(); rerr != nil {
+			err = fmt.Errorf("%w, and failed to restore %s: %v", err, k8sVersionConfig, rerr)
+		}
+		msg("upgrade", stk.fqsn, err)
+	}
+	refreshStack(ctx, s, stk)
+	if err := checkApprovals(ctx, s, stk, "create", cmd.approvals); err != nil {
+		fail(err)
+	}
+
+	// lke upgrades the control plane, new nodes get the new version
+	msg("deploying", stk.fqsn, nil)
+	opts := []optup.Option{colorUp{}, optup.ProgressStreams(stdout)}
+	if cmd.breakGlass != "" {
+		opts = append(opts, optup.Message("break glass: "+cmd.breakGlass))
+	}
+	res, err := stackUp(ctx, s, stk, opts...)
+	if err != nil {
+		fail(err)
+	}
+
+	// the control plane can't go back, so from here on the new version stays
+	id, _ := res.Outputs["lkeClusterId"].Value.(string)
+	if err := recyclePools(ctx, c, id, cmd.poolTimeout); err != nil {
+		msg("upgrade", stk.fqsn, err)
+	}
+	if err := attachFirewall(ctx, s, stk); err != nil {
+		msg("upgrade", stk.fqsn, err)
+	}
+	msg("upgrade", stk.fqsn, glass.record(ctx, s))
+	exit(0)
+}
+
+// recyclePools recycles one pool at a time, and waits until its old nodes are replaced by ready ones
+func recyclePools(ctx context.Context, c *linodeClient, cluster string, timeout time.Duration) error {
+	if cluster == "" {
+		return fmt.Errorf("the infra stack has no lkeClusterId output")
+	}
+	path := "/lke/clusters/" + cluster + "/pools"
+
+	pools, err := list[lkePool](ctx, c, path)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range pools {
+		fmt.Fprintf(stdout, "\n%s%-10s %s recycling pool %d of %d, %d %s nodes %s\n", Green, "[upgrade]", Grey, i+1, len(pools), len(p.Nodes), p.Type, Reset)
+
+		var old []string
+		for _, n := range p.Nodes {
+			old = append(old, n.Id)
+		}
+		if err := c.post(ctx, fmt.Sprintf("%s/%d/recycle", path, p.Id), nil); err != nil {
+			return fmt.Errorf("failed to recycle pool %d: %w", p.Id, err)
+		}
+		if err := waitRecycled(ctx, c, fmt.Sprintf("%s/%d", path, p.Id), old, timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitRecycled(ctx context.Context, c *linodeClient, path string, old []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	last := -1
+	for {
+		var p lkePool
+		if err := c.get(ctx, path, &p); err != nil {
+			return err
+		}
+
+		recycled, ready := 0, 0
+		for _, n := range p.Nodes {
+			if slices.Contains(old, n.Id) {
+				continue
+			}
+			recycled++
+			if n.Status == "ready" {
+				ready++
+			}
+		}
+		if ready != last {
+			fmt.Fprintf(stdout, "%s%-10s %d of %d nodes recycled and ready %s\n", Grey, "", ready, len(old), Reset)
+			last = ready
+		}
+		if recycled == len(p.Nodes) && ready == len(p.Nodes) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for pool %d to be recycled, %d of %d nodes ready", p.Id, ready, len(old))
+		case <-time.After(upgradePoll):
+		}
+	}
+}
+
+// minorVersion compares kubernetes versions by their minor version, e.g. 33 for 1.33
+func minorVersion(v string) int {
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	n, _ := strconv.Atoi(parts[1])
+
+	return n
+}
+
+// attachFirewall refreshes the recycled nodes into the stack, and updates only the firewall,
+// so the new linodes are covered without another approval of the whole stack
+func attachFirewall(ctx context.Context, s auto.Stack, stk microStack) error {
+	state, err := stackState(ctx, s)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(state, func(r stateResource) bool { return r.Type == firewallType })
+	if i < 0 {
+		return nil
+	}
+
+	fmt.Fprintf(stdout, "\n%s%-10s %s attaching the firewall to the recycled nodes %s\n", Green, "[upgrade]", Grey, Reset)
+	refreshStack(ctx, s, stk)
+	_, err = stackUp(ctx, s, stk, colorUp{}, optup.Target([]string{state[i].URN}), optup.ProgressStreams(stdout))
+	if err != nil {
+		return fmt.Errorf("failed to attach the firewall to the recycled nodes: %w", err)
+	}
+
+	return nil
+}
+
+// setK8sVersion sets apl:k8sVersion, and returns a func that restores the value it had before
+func setK8sVersion(ctx context.Context, s auto.Stack, version string) (func() error, error) {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	old, ok := cfg[k8sVersionConfig]
+	if err := s.SetConfig(ctx, k8sVersionConfig, auto.ConfigValue{Value: version}); err != nil {
+		return nil, err
+	}
+
+	// a cancelled upgrade restores the version too
+	ctx = context.WithoutCancel(ctx)
+	return func() error {
+		if ok {
+			return s.SetConfig(ctx, k8sVersionConfig, old)
+		}
+		return s.RemoveConfig(ctx, k8sVersionConfig)
+	}, nil
+}
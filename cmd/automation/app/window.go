@@ -0,0 +1,302 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// change policy config, windows and freezes are keyed by environment, so one
+// esc environment can define them for every stack
+const (
+	environmentConfig = "apl:environment"
+	windowsConfig     = "apl:maintenanceWindows"
+	freezesConfig     = "apl:changeFreezes"
+	production        = "production"
+
+	// break glass tags are aplcli:break-glass-<time>, with the op, user and reason
+	breakGlassTag = "aplcli:break-glass-"
+	maxTagValue   = 256
+)
+
+// changeWindow is a weekly maintenance window, e.g. "Sat,Sun 02:00-06:00 Europe/Amsterdam"
+type changeWindow struct {
+	days       [7]bool
+	start, end int
+	loc        *time.Location
+}
+
+// changeFreeze is a period without changes, with RFC 3339 or YYYY-MM-DD bounds
+type changeFreeze struct {
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Reason string `json:"reason"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWindow(s string) (changeWindow, error) {
+	w := changeWindow{loc: time.UTC}
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return w, fmt.Errorf("window %q is not <days> <HH:MM-HH:MM> [timezone]", s)
+	}
+
+	for _, d := range strings.Split(strings.ToLower(fields[0]), ",") {
+		if d == "*" {
+			w.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		from, to, isRange := strings.Cut(d, "-")
+		first, ok1 := weekdays[from]
+		last, ok2 := weekdays[to]
+		if !isRange {
+			last, ok2 = first, ok1
+		}
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("window %q has an unknown day %q", s, d)
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			w.days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("window %q has no HH:MM-HH:MM time range", s)
+	}
+	var err error
+	if w.start, err = clockMinutes(from); err != nil {
+		return w, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.end, err = clockMinutes(to); err != nil {
+		return w, fmt.Errorf("window %q: %w", s, err)
+	}
+
+	if len(fields) == 3 {
+		if w.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return w, fmt.Errorf("window %q: %w", s, err)
+		}
+	}
+
+	return w, nil
+}
+
+func clockMinutes(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	min, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || min < 0 || min > 59 || hour*60+min > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	return hour*60 + min, nil
+}
+
+// contains reports whether t is in the window, windows that pass midnight belong to the day they start
+func (w changeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	now := t.Hour()*60 + t.Minute()
+
+	if w.start <= w.end {
+		return w.days[t.Weekday()] && now >= w.start && now < w.end
+	}
+
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && now >= w.start) || (w.days[yesterday] && now < w.end)
+}
+
+func parseFreezeTime(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	// a date covers the whole day
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid freeze time %q, expected RFC 3339 or YYYY-MM-DD", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// changePolicy is the windows and freezes of the environment of a stack
+type changePolicy struct {
+	environment string
+	windows     []string
+	freezes     []changeFreeze
+}
+
+func readChangePolicy(cfg auto.ConfigMap) (changePolicy, error) {
+	p := changePolicy{environment: cfg[environmentConfig].Value}
+	if p.environment == "" {
+		return p, nil
+	}
+
+	if v := cfg[windowsConfig].Value; v != "" {
+		var windows map[string][]string
+		if err := json.Unmarshal([]byte(v), &windows); err != nil {
+			return p, fmt.Errorf("%s is not a map of environments to windows: %w", windowsConfig, err)
+		}
+		p.windows = windows[p.environment]
+	}
+
+	if v := cfg[freezesConfig].Value; v != "" {
+		var freezes map[string][]changeFreeze
+		if err := json.Unmarshal([]byte(v), &freezes); err != nil {
+			return p, fmt.Errorf("%s is not a map of environments to freezes: %w", freezesConfig, err)
+		}
+		p.freezes = freezes[p.environment]
+	}
+
+	return p, nil
+}
+
+// check refuses changes during a freeze, and changes to production outside its windows
+func (p changePolicy) check(now time.Time) error {
+	for _, f := range p.freezes {
+		start, err := parseFreezeTime(f.Start, false)
+		if err != nil {
+			return err
+		}
+		end, err := parseFreezeTime(f.End, true)
+		if err != nil {
+			return err
+		}
+		if !now.Before(start) && now.Before(end) {
+			return fmt.Errorf("%s is frozen until %s: %s", p.environment, f.End, f.Reason)
+		}
+	}
+
+	if p.environment != production || len(p.windows) == 0 {
+		return nil
+	}
+	for _, s := range p.windows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return err
+		}
+		if w.contains(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside its maintenance windows: %s", p.environment, strings.Join(p.windows, ", "))
+}
+
+// validChangePolicy checks windows and freezes when they are set with aplcli config
+func validChangePolicy(key, value string) error {
+	switch key {
+	case windowsConfig:
+		var windows map[string][]string
+		if err := json.Unmarshal([]byte(value), &windows); err != nil {
+			return fmt.Errorf("%s is not a map of environments to windows: %w", key, err)
+		}
+		for _, l := range windows {
+			for _, s := range l {
+				if _, err := parseWindow(s); err != nil {
+					return err
+				}
+			}
+		}
+	case freezesConfig:
+		var freezes map[string][]changeFreeze
+		if err := json.Unmarshal([]byte(value), &freezes); err != nil {
+			return fmt.Errorf("%s is not a map of environments to freezes: %w", key, err)
+		}
+		for _, l := range freezes {
+			for _, f := range l {
+				if _, err := parseFreezeTime(f.Start, false); err != nil {
+					return err
+				}
+				if _, err := parseFreezeTime(f.End, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// breakGlass is an override of the windows and freezes of a stack
+type breakGlass struct {
+	op, user, reason string
+	time             time.Time
+}
+
+// guardChange refuses a change to a stack outside its windows, unless the glass is broken.
+// The override is returned, and recorded once the change succeeded
+func guardChange(ctx context.Context, s auto.Stack, stk microStack, op, reason string) (*breakGlass, error) {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readChangePolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.check(time.Now())
+	if err == nil {
+		return nil, nil
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("refusing to %s %s, %w, use --break-glass \"<reason>\" to override", op, stk.fqsn, err)
+	}
+
+	who := breakGlassUser(ctx, s)
+	fmt.Fprintf(stdout, "\n%s%-10s %s %s overrides: %v %s\n", Red, "[glass]", Grey, who, err, Reset)
+
+	return &breakGlass{op: op, user: who, reason: reason, time: time.Now().UTC()}, nil
+}
+
+// record keeps the override as a stack tag named after its time, so the earlier ones stay.
+// Without an override, there is nothing to record
+func (g *breakGlass) record(ctx context.Context, s auto.Stack) error {
+	if g == nil {
+		return nil
+	}
+
+	name := breakGlassTag + g.time.Format("20060102T150405Z")
+	value := []rune(fmt.Sprintf("%s by %s: %s", g.op, g.user, g.reason))
+	if len(value) > maxTagValue {
+		value = value[:maxTagValue]
+	}
+	if err := s.SetTag(ctx, name, string(value)); err != nil {
+		return fmt.Errorf("failed to record the break glass reason: %w", err)
+	}
+
+	return nil
+}
+
+// breakGlassUser is the pulumi user, or the local user without a pulumi login
+func breakGlassUser(ctx context.Context, s auto.Stack) string {
+	if who, err := s.Workspace().WhoAmI(ctx); err == nil && who != "" {
+		return who
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseWindow(t *testing.T) {
+	w, err := parseWindow("fri-mon 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [7]bool{true, true, false, false, false, true, true}
+	if w.days != want || w.start != 22*60 || w.end != 2*60 || w.loc != time.UTC {
+		t.Fatalf("got %+v, want fri to mon from 22:00 to 02:00 utc", w)
+	}
+
+	w, err = parseWindow("Sat,Sun 02:00-06:00 Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.days[time.Saturday] || !w.days[time.Sunday] || w.days[time.Monday] || w.loc.String() != "Europe/Amsterdam" {
+		t.Fatalf("got %+v, want sat and sun in Europe/Amsterdam", w)
+	}
+
+	for _, s := range []string{
+		"mon",
+		"mon 01:00",
+		"xyz 01:00-02:00",
+		"mon-xyz 01:00-02:00",
+		"mon 25:00-26:00",
+		"mon 01:60-02:00",
+		"mon 01:00-02:00 Nowhere/City",
+		"mon 01:00-02:00 UTC extra",
+	} {
+		if _, err := parseWindow(s); err == nil {
+			t.Errorf("parseWindow(%q) is valid, want an error", s)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	tests := []struct {
+		window string
+		now    string
+		want   bool
+	}{
+		{"fri-mon 22:00-02:00", "2026-10-16T23:00:00Z", true},  // fri, before midnight
+		{"fri-mon 22:00-02:00", "2026-10-17T01:00:00Z", true},  // sat, the window of fri
+		{"fri-mon 22:00-02:00", "2026-10-20T01:59:00Z", true},  // tue, the window of mon
+		{"fri-mon 22:00-02:00", "2026-10-20T02:00:00Z", false}, // tue, the end is excluded
+		{"fri-mon 22:00-02:00", "2026-10-20T22:30:00Z", false}, // tue
+		{"fri-mon 22:00-02:00", "2026-10-21T01:00:00Z", false}, // wed, tue has no window
+		{"fri-mon 22:00-02:00", "2026-10-19T12:00:00Z", false}, // mon, between windows
+		{"* 00:00-24:00", "2026-10-21T12:00:00Z", true},
+		{"Sat 02:00-06:00 Europe/Amsterdam", "2026-01-03T01:30:00Z", true},  // 02:30 cet
+		{"Sat 02:00-06:00 Europe/Amsterdam", "2026-01-03T05:30:00Z", false}, // 06:30 cet
+		{"Sat 02:00-06:00 Europe/Amsterdam", "2026-10-17T00:30:00Z", true},  // 02:30 cest
+		{"Sat 02:00-06:00 Europe/Amsterdam", "2026-10-16T23:30:00Z", false}, // fri 23:30 utc is sat 01:30 cest
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(utc(tt.now)); got != tt.want {
+			t.Errorf("%q contains %s: got %t, want %t", tt.window, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestChangePolicyCheck(t *testing.T) {
+	windows := []string{"fri-mon 22:00-02:00"}
+	freezes := []changeFreeze{{Start: "2026-12-20", End: "2026-12-31", Reason: "holidays"}}
+
+	tests := []struct {
+		name    string
+		policy  changePolicy
+		now     string
+		allowed bool
+	}{
+		{"production in a window across midnight", changePolicy{production, windows, nil}, "2026-10-17T01:00:00Z", true},
+		{"production outside its windows", changePolicy{production, windows, nil}, "2026-10-21T01:00:00Z", false},
+		{"production without windows", changePolicy{production, nil, nil}, "2026-10-21T01:00:00Z", true},
+		{"staging outside the windows", changePolicy{"staging", windows, nil}, "2026-10-21T01:00:00Z", true},
+		{"staging in a freeze", changePolicy{"staging", nil, freezes}, "2026-12-25T12:00:00Z", false},
+		{"last day of a freeze", changePolicy{"staging", nil, freezes}, "2026-12-31T23:59:00Z", false},
+		{"after a freeze", changePolicy{"staging", nil, freezes}, "2027-01-01T00:00:00Z", true},
+		{"production in a window and a freeze", changePolicy{production, windows, freezes}, "2026-12-26T23:00:00Z", false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.check(utc(tt.now))
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: got %v, want allowed %t", tt.name, err, tt.allowed)
+		}
+	}
+
+	bad := changePolicy{production, []string{"mon"}, nil}
+	if err := bad.check(utc("2026-10-19T12:00:00Z")); err == nil {
+		t.Error("an invalid window is allowed, want an error")
+	}
+}
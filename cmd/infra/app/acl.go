@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// operatorIpUrl returns the public ip of the machine running the program
+const operatorIpUrl = "https://api.ipify.org"
+
+// ControlPlaneAcl is the apl:controlPlaneAcl config, e.g.
+// {"ipv4": ["203.0.113.0/24"], "ipv6": ["2001:db8::/32"], "operatorIp": true}
+type ControlPlaneAcl struct {
+	Ipv4       []string `json:"ipv4"`
+	Ipv6       []string `json:"ipv6"`
+	OperatorIp bool     `json:"operatorIp"`
+}
+
+// ParseControlPlaneAcl reads and validates the acl config, bare addresses become /32 or /128 cidrs
+func ParseControlPlaneAcl(s string) (ControlPlaneAcl, error) {
+	var acl ControlPlaneAcl
+	if err := json.Unmarshal([]byte(s), &acl); err != nil {
+		return acl, fmt.Errorf("apl:controlPlaneAcl is not an object of ipv4 and ipv6 cidrs: %w", err)
+	}
+
+	var err error
+	if acl.Ipv4, err = cidrs("apl:controlPlaneAcl", acl.Ipv4, false); err != nil {
+		return acl, err
+	}
+	if acl.Ipv6, err = cidrs("apl:controlPlaneAcl", acl.Ipv6, true); err != nil {
+		return acl, err
+	}
+	if len(acl.Ipv4) == 0 && len(acl.Ipv6) == 0 && !acl.OperatorIp {
+		return acl, fmt.Errorf("apl:controlPlaneAcl allows no addresses, which locks everyone out of the kubernetes api")
+	}
+
+	return acl, nil
+}
+
+// cidrs validates the addresses of a config key, and makes bare addresses /32 or /128 cidrs
+func cidrs(key string, l []string, v6 bool) ([]string, error) {
+	family, bits := "ipv4", "/32"
+	if v6 {
+		family, bits = "ipv6", "/128"
+	}
+
+	cidrList := make([]string, 0, len(l))
+	for _, s := range l {
+		cidr := s
+		if !strings.Contains(cidr, "/") {
+			cidr += bits
+		}
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an %s address or cidr", key, s, family)
+		}
+		if (ip.To4() == nil) != v6 {
+			return nil, fmt.Errorf("%s: %q is not an %s address or cidr", key, s, family)
+		}
+		cidrList = append(cidrList, ipnet.String())
+	}
+
+	return cidrList, nil
+}
+
+// addOperatorIp allows the public ip of the operator, so the program and aplcli can reach the api
+func (cp *ControlPlane) addOperatorIp(ctx context.Context) error {
+	ip, err := operatorIp(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find the operator ip for apl:controlPlaneAcl: %w", err)
+	}
+	if len(cp.Addrs) == 0 {
+		cp.Addrs = []AclAddr{{}}
+	}
+	if ip.To4() != nil {
+		cp.Addrs[0].Ipv4 = append(cp.Addrs[0].Ipv4, ip.String()+"/32")
+	} else {
+		cp.Addrs[0].Ipv6 = append(cp.Addrs[0].Ipv6, ip.String()+"/128")
+	}
+
+	return nil
+}
+
+func operatorIp(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, operatorIpUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if res.StatusCode != http.StatusOK || ip == nil {
+		return nil, fmt.Errorf("unexpected response from %s: %s", operatorIpUrl, res.Status)
+	}
+
+	return ip, nil
+}
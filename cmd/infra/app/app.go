@@ -2,7 +2,9 @@ package app
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
@@ -13,22 +15,49 @@ import (
 )
 
 const (
-	k8sVersion = "1.33"
-	objPrefix  = "apl"
-	nbLabel    = "StaticLoadbalancer"
-	nbTag      = "apl-static-lb"
-	stack      = "dev"
+	k8sVersion        = "1.33" // default, see apl:k8sVersion
+	objPrefix         = "apl"
+	nbLabel           = "StaticLoadbalancer"
+	platformTagPrefix = "apl-platform-"
+	stack             = "dev"
 )
 
+// NodeBalancerTag is set on the nodebalancer of the static loadbalancer, discovery and sweep
+// look for it
+const NodeBalancerTag = "apl-static-lb"
+
+// PlatformTag is set on the nodebalancer and volumes of a platform, and tells them apart from
+// those of other platforms in the same account and region
+func PlatformTag(label string) string {
+	return platformTagPrefix + label
+}
+
+// platformTags are set on the dns zone, cluster and node pools
+var platformTags = []string{
+	"marketplace",
+	"apl",
+	"dev",
+}
+
+// PlatformTags are the tags that build sets on the dns zone, cluster and node pools
+func PlatformTags() []string {
+	return slices.Clone(platformTags)
+}
+
 type PulumiResourceInfo struct {
 	Data      map[string]string
 	Resources map[string]interface{}
 	Token     string
+
+	// ApiUrl and ApiVersion point the linode provider at another api, e.g. a local stand-in
+	ApiUrl     string
+	ApiVersion string
 }
 
 type PulumiOpts struct {
 	DependsOn   []pulumi.Resource
 	DeletedWith pulumi.Resource
+	Provider    *linode.Provider
 }
 
 func (r *PulumiResourceInfo) Build(ctx *pulumi.Context) error {
@@ -36,11 +65,109 @@ func (r *PulumiResourceInfo) Build(ctx *pulumi.Context) error {
 	return err
 }
 
+// NewLinodeProvider creates the provider of every linode resource and invoke, from the token
+// and the optional api url and version, rather than the ambient default provider
+func (r *PulumiResourceInfo) NewLinodeProvider(ctx *pulumi.Context) (*linode.Provider, error) {
+	args := &linode.ProviderArgs{
+		Token: pulumi.ToSecret(pulumi.String(r.Token)).(pulumi.StringOutput),
+	}
+	if r.ApiUrl != "" {
+		args.Url = pulumi.String(r.ApiUrl)
+	}
+	if r.ApiVersion != "" {
+		args.ApiVersion = pulumi.String(r.ApiVersion)
+	}
+
+	provider, err := linode.NewProvider(ctx, "linodeProvider", args)
+	if err != nil {
+		return nil, err
+	}
+	r.Resources["linodeProvider"] = provider
+
+	return provider, nil
+}
+
 func (r *PulumiResourceInfo) Config(ctx *pulumi.Context) error {
 	err := conf(ctx, r)
 	return err
 }
 
+// PlannedPools returns the node pools that build deploys, with defaults set. Pools come
+// from apl:nodePools, or a single autoscaled default pool when it is not set
+func PlannedPools(data map[string]string) ([]NodePool, error) {
+	pools := []NodePool{{Name: "default", Autoscaler: true}}
+	if data["nodePools"] != "" {
+		var err error
+		if pools, err = ParseNodePools(data["nodePools"]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range pools {
+		np := &pools[i]
+		labels := map[string]string{
+			"platform":    data["label"],
+			"environment": "dev",
+		}
+		for k, v := range np.Labels {
+			labels[k] = v
+		}
+		np.Labels = labels
+		np.Tags = append(slices.Clone(platformTags), np.Tags...)
+		np.Autoscaler = np.Autoscaler || np.Max > 0
+		np.SetDefaults()
+	}
+
+	return pools, nil
+}
+
+// K8sVersion is the kubernetes version of the cluster, apl:k8sVersion or the default
+func K8sVersion(data map[string]string) string {
+	if v := data["k8sVersion"]; v != "" {
+		return v
+	}
+	return k8sVersion
+}
+
+// validK8sVersion fails the preview when lke doesn't offer the version
+func validK8sVersion(ctx *pulumi.Context, version string, provider *linode.Provider) error {
+	res, err := linode.GetLkeVersions(ctx, &linode.GetLkeVersionsArgs{}, pulumi.Provider(provider))
+	if err != nil {
+		return fmt.Errorf("failed to list lke versions: %w", err)
+	}
+
+	var versions []string
+	for _, v := range res.Versions {
+		versions = append(versions, v.Id)
+	}
+	if !slices.Contains(versions, version) {
+		return fmt.Errorf("apl:k8sVersion %s is not offered by lke, expected one of %s", version, strings.Join(versions, ", "))
+	}
+
+	return nil
+}
+
+// PlannedControlPlane returns the control plane options that build deploys, with the
+// acl of apl:controlPlaneAcl when it is set
+func PlannedControlPlane(data map[string]string) (ControlPlane, error) {
+	cp := ControlPlane{
+		HA: true,
+	}
+	if data["controlPlaneAcl"] == "" {
+		return cp, nil
+	}
+
+	acl, err := ParseControlPlaneAcl(data["controlPlaneAcl"])
+	if err != nil {
+		return cp, err
+	}
+	cp.Acl = true
+	cp.Addrs = []AclAddr{{Ipv4: acl.Ipv4, Ipv6: acl.Ipv6}}
+	cp.OperatorIp = acl.OperatorIp
+
+	return cp, nil
+}
+
 func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 	// cloud infra build func
 	var (
@@ -49,23 +176,11 @@ func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 		label      = r.Data["label"]
 		region     = r.Data["region"]
 	)
-	objBuckets := []string{
-		"loki",
-		"cnpg",
-		"velero",
-		"harbor",
-		"thanos",
-		"tempo",
-		"gitea",
-	}
-	nodeLabels := map[string]string{
-		"platform":    label,
-		"environment": "dev",
-	}
-	tags := []string{
-		"marketplace",
-		"apl",
-		"dev",
+	tags := platformTags
+
+	linodepv, err := r.NewLinodeProvider(ctx)
+	if err != nil {
+		return err
 	}
 
 	// obj: create a separate, region scoped key
@@ -74,7 +189,7 @@ func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 		Regions: pulumi.StringArray{
 			pulumi.String(region),
 		},
-	})
+	}, pulumi.Provider(linodepv))
 	if err != nil {
 		return err
 	}
@@ -93,7 +208,7 @@ func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 			Region:         pulumi.String(region),
 			Label:          pulumi.String(bucketName),
 			LifecycleRules: defaultLifecyclePolicy(),
-		}, pulumi.DependsOn([]pulumi.Resource{objkey}))
+		}, pulumi.DependsOn([]pulumi.Resource{objkey}), pulumi.Provider(linodepv))
 		if err != nil {
 			return err
 		}
@@ -110,7 +225,7 @@ func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 		SoaEmail: pulumi.String(email),
 		Tags:     tagArray,
 		TtlSec:   pulumi.Int(30),
-	})
+	}, pulumi.Provider(linodepv))
 	if err != nil {
 		return err
 	}
@@ -125,36 +240,71 @@ func build(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 			Name:       pulumi.String(""),
 			Tag:        pulumi.String("issuewild"),
 			TtlSec:     pulumi.Int(30),
-		}, pulumi.DeletedWith(domain))
+		}, pulumi.DeletedWith(domain), pulumi.Provider(linodepv))
 		return id
 	})
 	r.Resources["domain"] = domain
 	ctx.Export("domainName", pulumi.String(domainName))
 	ctx.Export("domainId", domain.ID())
 
-	// lke: configure node pools and control plane options
-	np := NodePool{
-		Autoscaler: true,
-		Labels:     nodeLabels,
-		Tags:       tags,
+	// vpc: optional, for the cluster and the nodebalancer backends
+	vpcCfg, err := ParseVpc(r.Data["vpc"], label)
+	if err != nil {
+		return err
+	}
+	if vpcCfg.Enabled {
+		vpc, err := NewVpc(ctx, "aplVpc", &VpcArgs{
+			Config: vpcCfg,
+			Region: region,
+		}, pulumi.Providers(linodepv))
+		if err != nil {
+			return err
+		}
+		r.Resources["vpc"] = vpc
+		ctx.Export("vpcId", vpc.Id)
+		ctx.Export("vpcSubnets", vpc.Subnets)
+
+		// the pinned linode provider has no vpc arguments for lke clusters yet
+		ctx.Log.Warn("lke clusters can't be placed in a vpc with this linode provider version, the nodes and nodebalancer backends stay on the private network", nil)
 	}
-	np.SetDefaults()
-	aplNodePool := lkeNodePool(np)
 
-	cp := ControlPlane{
-		HA: true,
+	// lke: configure node pools and control plane options, pools are matched by position,
+	// so new pools go at the end of apl:nodePools
+	planned, err := PlannedPools(r.Data)
+	if err != nil {
+		return err
+	}
+	if err := validNodePoolTypes(ctx, planned, linodepv); err != nil {
+		return err
+	}
+	version := K8sVersion(r.Data)
+	if err := validK8sVersion(ctx, version, linodepv); err != nil {
+		return err
+	}
+	var pools linode.LkeClusterPoolArray
+	for _, np := range planned {
+		pools = append(pools, lkeNodePool(np))
+	}
+	cp, err := PlannedControlPlane(r.Data)
+	if err != nil {
+		return err
+	}
+	if cp.OperatorIp {
+		if err := cp.addOperatorIp(ctx.Context()); err != nil {
+			return err
+		}
 	}
 	aplControlPlane := lkeControlPlane(cp)
 
 	// lke: deploy kubernetes cluster
 	aplcluster, err := linode.NewLkeCluster(ctx, label, &linode.LkeClusterArgs{
-		K8sVersion:   pulumi.String(k8sVersion),
+		K8sVersion:   pulumi.String(version),
 		Label:        pulumi.String(label),
-		Pools:        linode.LkeClusterPoolArray{aplNodePool},
+		Pools:        pools,
 		Region:       pulumi.String(region),
 		ControlPlane: aplControlPlane,
 		Tags:         utils.BuildPulumiStringArray(tags),
-	})
+	}, pulumi.Provider(linodepv))
 	if err != nil {
 		return err
 	}
@@ -186,56 +336,92 @@ func conf(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 	domain := r.Resources["domain"].(*linode.Domain)
 	lke := r.Resources["aplcluster"].(*linode.LkeCluster)
 	lkepv := r.Resources["lkeProvider"].(*kubernetes.Provider)
+	linodepv := r.Resources["linodeProvider"].(*linode.Provider)
 
-	// lke: use provider lookup func to get kube cluster id
-	_, ok := lke.ID().ApplyT(func(i string) (int, error) {
-		id, _ := strconv.Atoi(i)
-		res, err := linode.LookupLkeCluster(ctx, &linode.LookupLkeClusterArgs{
-			Id: id,
-		})
-		if err != nil {
-			return 0, nil
+	var rules []FirewallRule
+	if r.Data["firewallRules"] != "" {
+		var err error
+		if rules, err = ParseFirewallRules(r.Data["firewallRules"]); err != nil {
+			return err
 		}
+	}
 
-		retry := 0
-		for range 5 {
-			if res.Status == "ready" {
-				break
-			}
-			time.Sleep(5 * time.Second)
-			retry++
-		}
-		if res.Status != "ready" && retry == 5 {
-			return 0, fmt.Errorf("error: timeout waiting for lke cluster after %d tries", retry)
-		}
+	// lke: wait for the cluster, its nodes and the kubernetes api before using it
+	lkeReady, err := NewWaitForLke(ctx, "lkeReady", &WaitForLkeArgs{
+		Cluster:  lke,
+		Provider: linodepv,
+	}, pulumi.DependsOn([]pulumi.Resource{lke}))
+	if err != nil {
+		return err
+	}
+	r.Resources["lkeReady"] = lkeReady
+
+	// lke: a default storage class that tags the volumes of the platform
+	_, err = NewStorageClass(ctx, "aplBlockStorage", &StorageClassArgs{
+		KubeProvider: lkepv,
+		Ready:        lkeReady.Ready,
+		Tags:         []string{PlatformTag(label)},
+	}, pulumi.DependsOn([]pulumi.Resource{lke, lkepv, lkeReady}))
+	if err != nil {
+		return err
+	}
 
-		return id, nil
-	}).(pulumi.IntOutput)
+	// lke: provision static loadbalancer (linode nodebalancer)
+	lbTags := []string{NodeBalancerTag, PlatformTag(label)}
+	annotations := map[string]string{
+		"service.beta.kubernetes.io/linode-loadbalancer-tags":     strings.Join(lbTags, ","),
+		"service.beta.kubernetes.io/linode-loadbalancer-preserve": "true",
+	}
 
-	if ok {
-		// lke: provision static loadbalancer (linode nodebalancer)
-		annotations := map[string]string{
-			"service.beta.kubernetes.io/linode-loadbalancer-tags":     nbTag,
-			"service.beta.kubernetes.io/linode-loadbalancer-preserve": "true",
-		}
+	nbConfig, err := ParseNodeBalancer(r.Data["nodebalancer"], label)
+	if err != nil {
+		return err
+	}
+	lookupTimeout, lookupBackoff, err := ParseLookupTiming(r.Data["nodebalancerLookupTimeout"], r.Data["nodebalancerLookupBackoff"])
+	if err != nil {
+		return err
+	}
 
-		// lke: deploy a static loadbalancer to the cluster
-		loadbalancer, err := NewStaticLoadbalancer(ctx, nbLabel, &StaticLoadbalancerArgs{
-			Annotations: annotations,
-			Label:       nbLabel,
-			Kubecfg:     label,
-			Region:      region,
-		}, pulumi.DependsOn([]pulumi.Resource{lke, lkepv}), pulumi.DeletedWith(domain))
-		if err != nil {
-			return err
-		}
-		r.Resources["loadbalancer"] = loadbalancer
+	// lke: deploy a static loadbalancer to the cluster, or create a nodebalancer that the
+	// stack owns and the ingress adopts
+	lbOpts := []pulumi.ResourceOption{pulumi.Providers(linodepv)}
+	if !nbConfig.Managed {
+		lbOpts = append(lbOpts, pulumi.DependsOn([]pulumi.Resource{lke, lkepv, lkeReady}), pulumi.DeletedWith(domain))
+	}
+	loadbalancer, err := NewStaticLoadbalancer(ctx, nbLabel, &StaticLoadbalancerArgs{
+		Annotations:    annotations,
+		KubeProvider:   lkepv,
+		Label:          nbLabel,
+		LinodeProvider: linodepv,
+		NodeBalancer:   nbConfig,
+		Ready:          lkeReady.Ready,
+		Region:         region,
+		Tags:           lbTags,
+		LookupTimeout:  lookupTimeout,
+		LookupBackoff:  lookupBackoff,
+	}, lbOpts...)
+	if err != nil {
+		return err
 	}
+	r.Resources["loadbalancer"] = loadbalancer
 
 	// dns: set default dns records for loadbalancer
 	lb := r.Resources["loadbalancer"].(*StaticLoadbalancer)
-	dnsOpts := PulumiOpts{DependsOn: []pulumi.Resource{lb}}
-	dnsRec := func(ip, name, typ string) DnsRecord {
+
+	// firewall: only what lke needs, and http and https, reach the nodes and nodebalancer
+	fw, err := NewFirewall(ctx, "aplFirewall", &FirewallArgs{
+		Label:         fmt.Sprintf("%s-firewall", label),
+		Linodes:       poolLinodes(lke),
+		Nodebalancers: nodebalancerIds(lb.Id),
+		Rules:         rules,
+		Tags:          platformTags,
+	}, pulumi.DependsOn([]pulumi.Resource{lb}), pulumi.Providers(linodepv))
+	if err != nil {
+		return err
+	}
+	ctx.Export("firewallId", fw.Id)
+	dnsOpts := PulumiOpts{DependsOn: []pulumi.Resource{lb}, Provider: linodepv}
+	dnsRec := func(ip pulumi.StringInput, name, typ string) DnsRecord {
 		return DnsRecord{Domain: domain, Opts: dnsOpts, Name: name, RecType: typ, Target: ip}
 	}
 	subdomains := map[string]string{
@@ -244,36 +430,31 @@ func conf(ctx *pulumi.Context, r *PulumiResourceInfo) error {
 		"api":      fmt.Sprintf("api.%s", domainName),
 	}
 
-	// dns: root domain ipv4 record
-	if lb.Ipv4 != "" {
-		err := AddDnsRecord(ctx, dnsRec(lb.Ipv4, "", "A"))
+	// dns: root domain records, and the subdomains on ipv4
+	for typ, ip := range lb.Addresses() {
+		err := AddDnsRecord(ctx, dnsRec(ip, "", typ))
 		if err != nil {
 			return err
 		}
-
-		// dns: subdomains
-		for k := range subdomains {
-			err = AddDnsRecord(ctx, dnsRec(lb.Ipv4, k, "A"))
+		if typ != "A" {
+			continue
 		}
-		if err != nil {
-			return err
-		}
-	}
-
-	// dns: root domain ipv6 record
-	if lb.Ipv6 != "" {
-		err := AddDnsRecord(ctx, dnsRec(lb.Ipv6, "", "AAAA"))
-		if err != nil {
-			return err
+		for k := range subdomains {
+			err = AddDnsRecord(ctx, dnsRec(ip, k, typ))
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// export any remaining outputs we might want for the next stack
 	exportVars := map[string]interface{}{
-		"loadbalancerTag": pulumi.String("apl-static-lb"),
-		"region":          pulumi.String(region),
-		"aplDemoLabel":    pulumi.String(label),
-		"subdomains":      utils.BuildPulumiStringMap(subdomains),
+		"loadbalancerTag":      pulumi.String(strings.Join(lb.Tags, ",")),
+		"loadbalancerThrottle": pulumi.String(strconv.Itoa(lb.Throttle)),
+		"loadbalancerManaged":  pulumi.Bool(nbConfig.Managed),
+		"region":               pulumi.String(region),
+		"aplDemoLabel":         pulumi.String(label),
+		"subdomains":           utils.BuildPulumiStringMap(subdomains),
 	}
 
 	for k, i := range exportVars {
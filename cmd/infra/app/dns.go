@@ -15,7 +15,7 @@ type DnsRecord struct {
 	RecType      string
 	ResourceName string
 	Tag          string
-	Target       string
+	Target       pulumi.StringInput
 	Ttl          int
 }
 
@@ -53,14 +53,18 @@ func AddDnsRecord(ctx *pulumi.Context, d DnsRecord) error {
 	d.SetDefaults()
 	id, ok := GetDomainId(d.Domain)
 	if ok {
+		opts := []pulumi.ResourceOption{pulumi.DependsOn(d.Opts.DependsOn), pulumi.DeletedWith(d.Domain)}
+		if d.Opts.Provider != nil {
+			opts = append(opts, pulumi.Provider(d.Opts.Provider))
+		}
 		_, err := linode.NewDomainRecord(ctx, d.ResourceName, &linode.DomainRecordArgs{
 			DomainId:   id,
 			Name:       pulumi.String(d.Name),
 			RecordType: pulumi.String(d.RecType),
 			Tag:        pulumi.String(d.Tag),
-			Target:     pulumi.String(d.Target),
+			Target:     d.Target,
 			TtlSec:     pulumi.Int(d.Ttl),
-		}, pulumi.DependsOn(d.Opts.DependsOn), pulumi.DeletedWith(d.Domain))
+		}, opts...)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	utils "github.com/rylabs-billy/steal-this-idp/utils"
+
+	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	// lkePrivateRange is the private network of lke nodes, and nbPrivateRange the one
+	// nodebalancers reach the backends from
+	lkePrivateRange = "192.168.128.0/17"
+	nbPrivateRange  = "192.168.255.0/24"
+)
+
+var (
+	firewallProtocols = []string{"TCP", "UDP", "ICMP", "IPENCAP"}
+	firewallActions   = []string{"ACCEPT", "DROP"}
+)
+
+// FirewallRule is an inbound rule, and the shape of an apl:firewallRules entry
+type FirewallRule struct {
+	Label    string   `json:"label"`
+	Action   string   `json:"action"`
+	Protocol string   `json:"protocol"`
+	Ports    string   `json:"ports"`
+	Ipv4     []string `json:"ipv4"`
+	Ipv6     []string `json:"ipv6"`
+}
+
+type Firewall struct {
+	pulumi.ResourceState
+
+	Id pulumi.IDOutput `pulumi:"firewallId"`
+}
+
+type FirewallArgs struct {
+	Label         string
+	Linodes       pulumi.IntArrayInput
+	Nodebalancers pulumi.IntArrayInput
+	Rules         []FirewallRule
+	Tags          []string
+}
+
+// lkeFirewallRules are the rules lke needs between nodes and from nodebalancers, and the
+// public http and https of the ingress
+func lkeFirewallRules() []FirewallRule {
+	return []FirewallRule{
+		{Label: "lke-kubelet", Protocol: "TCP", Ports: "10250", Ipv4: []string{lkePrivateRange}},
+		{Label: "lke-wireguard", Protocol: "UDP", Ports: "51820", Ipv4: []string{lkePrivateRange}},
+		{Label: "lke-calico-bgp", Protocol: "TCP", Ports: "179", Ipv4: []string{lkePrivateRange}},
+		{Label: "lke-ipencap", Protocol: "IPENCAP", Ipv4: []string{lkePrivateRange}},
+		{Label: "lke-nodeports-tcp", Protocol: "TCP", Ports: "30000-32767", Ipv4: []string{nbPrivateRange}},
+		{Label: "lke-nodeports-udp", Protocol: "UDP", Ports: "30000-32767", Ipv4: []string{nbPrivateRange}},
+		{Label: "public-http", Protocol: "TCP", Ports: "80", Ipv4: []string{"0.0.0.0/0"}, Ipv6: []string{"::/0"}},
+		{Label: "public-https", Protocol: "TCP", Ports: "443", Ipv4: []string{"0.0.0.0/0"}, Ipv6: []string{"::/0"}},
+	}
+}
+
+// ParseFirewallRules reads the extra inbound rules of apl:firewallRules, e.g.
+// [{"label": "office-ssh", "protocol": "TCP", "ports": "22", "ipv4": ["203.0.113.0/24"]}]
+func ParseFirewallRules(s string) ([]FirewallRule, error) {
+	var rules []FirewallRule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, fmt.Errorf("apl:firewallRules is not a list of firewall rules: %w", err)
+	}
+
+	var labels []string
+	for _, l := range lkeFirewallRules() {
+		labels = append(labels, l.Label)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.Label == "" {
+			return nil, fmt.Errorf("apl:firewallRules: rule %d has no label", i)
+		}
+		if slices.Contains(labels, r.Label) {
+			return nil, fmt.Errorf("apl:firewallRules: rule %s is already defined", r.Label)
+		}
+		labels = append(labels, r.Label)
+
+		if r.Action == "" {
+			r.Action = "ACCEPT"
+		}
+		r.Action = strings.ToUpper(r.Action)
+		r.Protocol = strings.ToUpper(r.Protocol)
+		if !slices.Contains(firewallActions, r.Action) {
+			return nil, fmt.Errorf("apl:firewallRules: rule %s has action %q, expected one of %s", r.Label, r.Action, strings.Join(firewallActions, ", "))
+		}
+		if !slices.Contains(firewallProtocols, r.Protocol) {
+			return nil, fmt.Errorf("apl:firewallRules: rule %s has protocol %q, expected one of %s", r.Label, r.Protocol, strings.Join(firewallProtocols, ", "))
+		}
+		if len(r.Ipv4) == 0 && len(r.Ipv6) == 0 {
+			return nil, fmt.Errorf("apl:firewallRules: rule %s has no addresses", r.Label)
+		}
+
+		var err error
+		if r.Ipv4, err = cidrs("apl:firewallRules", r.Ipv4, false); err != nil {
+			return nil, err
+		}
+		if r.Ipv6, err = cidrs("apl:firewallRules", r.Ipv6, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// poolLinodes returns the linode instance ids of every node in the cluster's pools, as the
+// stack state knows them. Nodes that the autoscaler adds, or a recycle replaces, are new
+// linodes without the firewall until the next up after a refresh. aplcli upgrade does that
+// after it recycles the pools
+func poolLinodes(c *linode.LkeCluster) pulumi.IntArrayOutput {
+	return c.Pools.ApplyT(func(pools []linode.LkeClusterPool) []int {
+		var ids []int
+		for _, p := range pools {
+			for _, n := range p.Nodes {
+				if n.InstanceId != nil {
+					ids = append(ids, *n.InstanceId)
+				}
+			}
+		}
+
+		return ids
+	}).(pulumi.IntArrayOutput)
+}
+
+// NewFirewall drops inbound traffic to the nodes and nodebalancer, except for the lke rules,
+// public http and https, and any extra rules
+func NewFirewall(ctx *pulumi.Context, name string, args *FirewallArgs, opts ...pulumi.ResourceOption) (*Firewall, error) {
+	var firewallResource Firewall
+
+	err := ctx.RegisterComponentResource("pkg:index:Firewall", name, &firewallResource, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var inbounds linode.FirewallInboundArray
+	for _, r := range append(lkeFirewallRules(), args.Rules...) {
+		rule := linode.FirewallInboundArgs{
+			Label:    pulumi.String(r.Label),
+			Action:   pulumi.String("ACCEPT"),
+			Protocol: pulumi.String(r.Protocol),
+		}
+		if r.Action != "" {
+			rule.Action = pulumi.String(r.Action)
+		}
+		if r.Ports != "" {
+			rule.Ports = pulumi.String(r.Ports)
+		}
+		if utils.AssertResource(r.Ipv4) {
+			rule.Ipv4s = utils.BuildPulumiStringArray(r.Ipv4)
+		}
+		if utils.AssertResource(r.Ipv6) {
+			rule.Ipv6s = utils.BuildPulumiStringArray(r.Ipv6)
+		}
+		inbounds = append(inbounds, rule)
+	}
+
+	fw, err := linode.NewFirewall(ctx, name, &linode.FirewallArgs{
+		Label:          pulumi.String(args.Label),
+		InboundPolicy:  pulumi.String("DROP"),
+		Inbounds:       inbounds,
+		OutboundPolicy: pulumi.String("ACCEPT"),
+		Linodes:        args.Linodes,
+		Nodebalancers:  args.Nodebalancers,
+		Tags:           utils.BuildPulumiStringArray(args.Tags),
+	}, pulumi.Parent(&firewallResource))
+	if err != nil {
+		return nil, err
+	}
+	firewallResource.Id = fw.ID()
+
+	ctx.RegisterResourceOutputs(&firewallResource, pulumi.Map{
+		"firewallId": fw.ID(),
+	})
+
+	return &firewallResource, nil
+}
+
+// nodebalancerIds converts the id of the static loadbalancer for the firewall, if it has one
+func nodebalancerIds(id pulumi.StringOutput) pulumi.IntArrayOutput {
+	return id.ApplyT(func(id string) []int {
+		n, err := strconv.Atoi(id)
+		if err != nil || n == 0 {
+			return nil
+		}
+
+		return []int{n}
+	}).(pulumi.IntArrayOutput)
+}
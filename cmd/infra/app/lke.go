@@ -3,20 +3,23 @@ package app
 import (
 	"encoding/base64"
 	"fmt"
-	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	utils "github.com/rylabs-billy/steal-this-idp/utils"
 
-	"github.com/pulumi/pulumi-command/sdk/go/command/local"
 	"gopkg.in/yaml.v2"
 
 	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/core/v1"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	storagev1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/storage/v1"
 	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
 type AclAddr struct {
@@ -24,8 +27,9 @@ type AclAddr struct {
 }
 
 type ControlPlane struct {
-	Acl, HA bool
-	Addrs   []AclAddr
+	Acl, HA    bool
+	Addrs      []AclAddr
+	OperatorIp bool
 }
 
 type LkeProvider struct {
@@ -40,28 +44,54 @@ type LkeProviderArgs struct {
 }
 
 type NodePool struct {
-	Autoscaler bool
-	Count      int
-	Labels     map[string]string
-	Max        int
-	Tags       []string
-	Type       string
+	Autoscaler bool              `json:"-"`
+	Count      int               `json:"count"`
+	Labels     map[string]string `json:"labels"`
+	Max        int               `json:"max"`
+	Min        int               `json:"min"`
+	Name       string            `json:"name"`
+	Tags       []string          `json:"tags"`
+	Taints     []Taint           `json:"taints"`
+	Type       string            `json:"type"`
 }
 
 type StaticLoadbalancer struct {
 	pulumi.ResourceState
 
-	Id    string              `pulumi:"StaticLoadbalancer"`
-	Ipv4  string              `pulumi:"StaticLoadbalancerIpv4"`
-	Ipv6  string              `pulumi:"StaticLoadbalancerIpv6"`
+	Id    pulumi.StringOutput `pulumi:"StaticLoadbalancerId"`
+	Ipv4  pulumi.StringOutput `pulumi:"StaticLoadbalancerIpv4"`
+	Ipv6  pulumi.StringOutput `pulumi:"StaticLoadbalancerIpv6"`
 	Label pulumi.StringOutput `pulumi:"StaticLoadbalancer"`
+
+	// Tags and Throttle are passed to the ingress annotations, so the cloud controller keeps them
+	Tags     []string
+	Throttle int
+
+	NodeBalancer *linode.NodeBalancer
+	Service      *corev1.Service
 }
 
 type StaticLoadbalancerArgs struct {
-	Annotations map[string]string
-	Label       string
-	Kubecfg     string
-	Region      string
+	Annotations    map[string]string
+	KubeProvider   *kubernetes.Provider
+	Label          string
+	LinodeProvider *linode.Provider
+	NodeBalancer   NodeBalancerConfig
+	Ready          pulumi.BoolInput
+	Region         string
+
+	// Tags are set on the nodebalancer by the cloud controller, and discovery looks for them
+	Tags []string
+
+	// LookupTimeout and LookupBackoff tune the nodebalancer lookups, see NodeBalancerLookup
+	LookupTimeout time.Duration
+	LookupBackoff time.Duration
+}
+
+type StorageClassArgs struct {
+	KubeProvider *kubernetes.Provider
+	Ready        pulumi.BoolInput
+	Tags         []string
 }
 
 type KubeSvc struct {
@@ -79,6 +109,17 @@ func (np *NodePool) SetDefaults() {
 
 	if np.Count == 0 {
 		np.Count = 3
+		if np.Min > 0 {
+			np.Count = np.Min
+		}
+	}
+
+	// the default count stays between min and max, e.g. 2 for a max of 2
+	if np.Autoscaler {
+		np.Count = min(max(np.Count, np.Min), np.Max)
+		if np.Min == 0 {
+			np.Min = np.Count
+		}
 	}
 
 	if np.Type == "" {
@@ -88,15 +129,16 @@ func (np *NodePool) SetDefaults() {
 
 func lkeNodePool(np NodePool) linode.LkeClusterPoolArgs {
 	var (
-		autoscale linode.LkeClusterPoolAutoscalerArgs
+		autoscale linode.LkeClusterPoolAutoscalerPtrInput
 		nodeTags  pulumi.StringArray
+		taints    linode.LkeClusterPoolTaintArray
 	)
 	nodeLabels := pulumi.StringMap{}
 
 	if np.Autoscaler {
 		autoscale = linode.LkeClusterPoolAutoscalerArgs{
 			Max: pulumi.Int(np.Max),
-			Min: pulumi.Int(np.Count),
+			Min: pulumi.Int(np.Min),
 		}
 	}
 
@@ -112,12 +154,21 @@ func lkeNodePool(np NodePool) linode.LkeClusterPoolArgs {
 		}
 	}
 
+	for _, t := range np.Taints {
+		taints = append(taints, linode.LkeClusterPoolTaintArgs{
+			Effect: pulumi.String(t.Effect),
+			Key:    pulumi.String(t.Key),
+			Value:  pulumi.String(t.Value),
+		})
+	}
+
 	nodePool := linode.LkeClusterPoolArgs{
 		Type:       pulumi.String(np.Type),
 		Autoscaler: autoscale,
 		Count:      pulumi.Int(np.Count),
 		Labels:     nodeLabels,
 		Tags:       nodeTags,
+		Taints:     taints,
 	}
 
 	return nodePool
@@ -129,13 +180,11 @@ func lkeControlPlane(cp ControlPlane) linode.LkeClusterControlPlaneArgs {
 		addrs   linode.LkeClusterControlPlaneAclAddressArray
 	)
 
+	// addresses are cidrs, validated by ParseControlPlaneAcl
 	ipArray := func(f []string) pulumi.StringArray {
 		var ips pulumi.StringArray
 		for _, i := range f {
-			ip := net.ParseIP(i)
-			if ip != nil {
-				ips = append(ips, pulumi.String(i))
-			}
+			ips = append(ips, pulumi.String(i))
 		}
 
 		return ips
@@ -151,7 +200,7 @@ func lkeControlPlane(cp ControlPlane) linode.LkeClusterControlPlaneArgs {
 			}
 
 			if utils.AssertResource(i.Ipv6) {
-				addrArgs.Ipv4s = ipArray(i.Ipv4)
+				addrArgs.Ipv6s = ipArray(i.Ipv6)
 			}
 			addrs = append(addrs, addrArgs)
 		}
@@ -231,7 +280,6 @@ func NewLkeProvider(ctx *pulumi.Context, providerName string, args *LkeProviderA
 
 func NewStaticLoadbalancer(ctx *pulumi.Context, loadbalancerName string, args *StaticLoadbalancerArgs, opts ...pulumi.ResourceOption) (*StaticLoadbalancer, error) {
 	var loadbalancerResource StaticLoadbalancer
-	region := args.Region
 
 	// default label if none was provided
 	if args.Label == "" {
@@ -243,43 +291,19 @@ func NewStaticLoadbalancer(ctx *pulumi.Context, loadbalancerName string, args *S
 		return nil, err
 	}
 
-	// create static loadbalancer service
-	svcName := strings.ToLower(args.Label)
-	svc := KubeSvc{
-		Args:   args,
-		Name:   svcName,
-		Parent: &loadbalancerResource,
+	if args.NodeBalancer.Managed {
+		err = managedNodeBalancer(ctx, args, &loadbalancerResource)
+	} else {
+		err = discoveredNodeBalancer(ctx, args, &loadbalancerResource)
 	}
-
-	// only proceed if a matching nodebalancer does not already exist
-	nbid, _ := ctx.GetConfig("nodebalancer-id")
-	nb := GetNodeBalancer(ctx, region, nbTag)
-
-	err = KubeService(ctx, svc, &loadbalancerResource)
 	if err != nil {
 		return nil, err
 	}
 
-	// get nodebalancer (loadbalancer info)
-	nb = GetNodeBalancer(ctx, region, nbTag)
-	id := strconv.Itoa(nb.id)
+	ctx.Export("loadbalancerId", loadbalancerResource.Id)
+	ctx.Export("ipv4", loadbalancerResource.Ipv4)
+	ctx.Export("ipv6", loadbalancerResource.Ipv6)
 
-	// log to stdout if nodebalancer config has drifted
-	if id != nbid {
-		msg := fmt.Sprintf("\n[debug] nodebalancer drift\nwant %s, got %s", id, nbid)
-		ctx.Log.Debug(msg, &pulumi.LogArgs{
-			Resource:  &loadbalancerResource,
-			Ephemeral: true,
-		})
-	}
-
-	ctx.Export("loadbalancerId", pulumi.String(id))
-	ctx.Export("ipv4", pulumi.String(nb.ipv4))
-	ctx.Export("ipv6", pulumi.String(nb.ipv6))
-
-	loadbalancerResource.Ipv4 = nb.ipv4
-	loadbalancerResource.Ipv6 = nb.ipv6
-	loadbalancerResource.Id = id
 	loadbalancerResource.Label = pulumi.String(args.Label).ToStringOutput()
 
 	ctx.RegisterResourceOutputs(&loadbalancerResource, pulumi.Map{
@@ -289,66 +313,176 @@ func NewStaticLoadbalancer(ctx *pulumi.Context, loadbalancerName string, args *S
 	return &loadbalancerResource, nil
 }
 
-func KubeService(ctx *pulumi.Context, svc KubeSvc, p *StaticLoadbalancer) error {
-	fileName := fmt.Sprintf("%v-kubeconfig.yaml", svc.Args.Kubecfg)
-	homeDir := os.Getenv("HOME")
-	kubeconfig := filepath.Join(homeDir, ".kube", fileName)
-
-	// create
-	// note: look into refactoring this with pulumi resource hooks
-	// https://www.pulumi.com/docs/iac/concepts/options/hooks/
-	cmd := fmt.Sprintf("export KUBECONFIG=%s; kubectl create svc loadbalancer %s --tcp=80,443", kubeconfig, svc.Name)
-	createCmd, err := local.NewCommand(ctx, "createService", &local.CommandArgs{
-		Create: pulumi.String(cmd),
-		Interpreter: pulumi.StringArray{
-			pulumi.String("/bin/bash"),
-			pulumi.String("-c"),
-		},
-		Triggers: pulumi.Array{
-			pulumi.String(kubeconfig),
-		},
-	}, pulumi.Parent(p))
+// managedNodeBalancer creates the nodebalancer in the stack. There is no service for it here,
+// the ingress of the apl stack adopts it by id
+func managedNodeBalancer(ctx *pulumi.Context, args *StaticLoadbalancerArgs, lb *StaticLoadbalancer) error {
+	cfg := args.NodeBalancer
+	nb, err := linode.NewNodeBalancer(ctx, cfg.Label, &linode.NodeBalancerArgs{
+		Label:              pulumi.String(cfg.Label),
+		Region:             pulumi.String(args.Region),
+		ClientConnThrottle: pulumi.Int(*cfg.Throttle),
+		Tags:               utils.BuildPulumiStringArray(cfg.Tags),
+	}, pulumi.Parent(lb))
 	if err != nil {
 		return err
 	}
 
-	// annotate
-	var annotateCmd *local.Command
-	count := -1
-	for k, v := range svc.Args.Annotations {
-		count++
-		rname := fmt.Sprintf("Annotate-%s-%d", svc.Name, count)
-		cmd := fmt.Sprintf("export KUBECONFIG=%s; kubectl annotate svc %s %s=%s", kubeconfig, svc.Name, k, v)
-		annotateCmd, err = local.NewCommand(ctx, rname, &local.CommandArgs{
-			Create: pulumi.String(cmd),
-			Interpreter: pulumi.StringArray{
-				pulumi.String("/bin/bash"),
-				pulumi.String("-c"),
-			},
-			Triggers: pulumi.Array{
-				pulumi.NewResourceOutput(createCmd),
-			},
-		}, pulumi.DependsOn([]pulumi.Resource{createCmd}), pulumi.IgnoreChanges([]string{"create"}), pulumi.Parent(p))
+	lb.NodeBalancer = nb
+	lb.Id = nb.ID().ToStringOutput()
+	lb.Ipv4 = nb.Ipv4
+	lb.Ipv6 = nb.Ipv6
+	lb.Tags = cfg.Tags
+	lb.Throttle = *cfg.Throttle
+
+	return nil
+}
+
+// discoveredNodeBalancer has the cloud controller create the nodebalancer, and looks it up by
+// tag. On the first deploy, a placeholder service without a selector makes the cloud
+// controller create it. Once its id is in the nodebalancer-id config, the ingress of the apl
+// stack adopts the nodebalancer, and the placeholder is removed from the program, so only one
+// service claims it. The preserve annotation keeps the nodebalancer when the placeholder goes
+func discoveredNodeBalancer(ctx *pulumi.Context, args *StaticLoadbalancerArgs, lb *StaticLoadbalancer) error {
+	lb.Tags = args.Tags
+	lb.Throttle = 20
+
+	// aplcli sets the id without a namespace, so it is config of the project
+	nbid := config.Get(ctx, "nodebalancer-id")
+	if nbid != "" {
+		id, err := strconv.Atoi(nbid)
 		if err != nil {
-			return err
+			return fmt.Errorf("nodebalancer-id %q is not a nodebalancer id: %w", nbid, err)
 		}
+		found, err := GetNodeBalancer(ctx, NodeBalancerLookup{
+			Region:   args.Region,
+			Tags:     []string{NodeBalancerTag},
+			Id:       id,
+			Provider: args.LinodeProvider,
+			Timeout:  args.LookupTimeout,
+			Backoff:  args.LookupBackoff,
+		})
+		if err != nil {
+			return fmt.Errorf("nodebalancer drift, nodebalancer-id %s is gone or lost its %s tag: %w", nbid, NodeBalancerTag, err)
+		}
+		warnNodeBalancerDrift(ctx, args, lb, id)
+
+		lb.Id = pulumi.String(nbid).ToStringOutput()
+		lb.Ipv4 = pulumi.String(found.Ipv4).ToStringOutput()
+		lb.Ipv6 = pulumi.String(found.Ipv6).ToStringOutput()
+		return nil
 	}
 
-	// delete
-	cmd = fmt.Sprintf("export KUBECONFIG=%s; kubectl delete svc %s", kubeconfig, svc.Name)
-	_, err = local.NewCommand(ctx, "deleteService", &local.CommandArgs{
-		Create: pulumi.String(cmd),
-		Interpreter: pulumi.StringArray{
-			pulumi.String("/bin/bash"),
-			pulumi.String("-c"),
-		},
-		Triggers: pulumi.Array{
-			pulumi.NewResourceOutput(annotateCmd),
-		},
-	}, pulumi.DependsOn([]pulumi.Resource{annotateCmd}), pulumi.Parent(p))
+	svc := KubeSvc{
+		Args:   args,
+		Name:   strings.ToLower(args.Label),
+		Parent: lb,
+	}
+	service, err := KubeService(ctx, svc, lb)
 	if err != nil {
 		return err
 	}
+	lb.Service = service
+
+	// get nodebalancer (loadbalancer info), once the service has its address
+	nb := service.Status.ApplyT(func(st *corev1.ServiceStatus) (map[string]string, error) {
+		lookup := NodeBalancerLookup{
+			Region:   args.Region,
+			Tags:     args.Tags,
+			Provider: args.LinodeProvider,
+			Timeout:  args.LookupTimeout,
+			Backoff:  args.LookupBackoff,
+		}
+		if st != nil && st.LoadBalancer != nil && len(st.LoadBalancer.Ingress) > 0 && st.LoadBalancer.Ingress[0].Ip != nil {
+			lookup.Ipv4 = *st.LoadBalancer.Ingress[0].Ip
+		}
+
+		found, err := GetNodeBalancer(ctx, lookup)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]string{"id": strconv.Itoa(found.Id), "ipv4": found.Ipv4, "ipv6": found.Ipv6}, nil
+	}).(pulumi.StringMapOutput)
+
+	lb.Id = nb.MapIndex(pulumi.String("id"))
+	lb.Ipv4 = nb.MapIndex(pulumi.String("ipv4"))
+	lb.Ipv6 = nb.MapIndex(pulumi.String("ipv6"))
 
 	return nil
 }
+
+// warnNodeBalancerDrift warns about other nodebalancers with the tags of this platform, which
+// the cloud controller creates for an ingress that lost its nodebalancer-id annotation
+func warnNodeBalancerDrift(ctx *pulumi.Context, args *StaticLoadbalancerArgs, lb *StaticLoadbalancer, id int) {
+	res, err := searchNodeBalancer(ctx, NodeBalancerLookup{
+		Region:   args.Region,
+		Tags:     args.Tags,
+		Provider: args.LinodeProvider,
+	})
+	if err != nil {
+		ctx.Log.Warn(fmt.Sprintf("nodebalancer drift was not checked: %v", err), &pulumi.LogArgs{Resource: lb})
+		return
+	}
+
+	for _, nb := range res.Nodebalancers {
+		if nb.Id == id {
+			continue
+		}
+		msg := fmt.Sprintf("nodebalancer drift: %s (%d) has the tags of this platform, but nodebalancer-id is %d, see aplcli sweep", nb.Label, nb.Id, id)
+		ctx.Log.Warn(msg, &pulumi.LogArgs{Resource: lb})
+	}
+}
+
+// Addresses are the dns record types of the loadbalancer, and their targets
+func (lb *StaticLoadbalancer) Addresses() map[string]pulumi.StringOutput {
+	return map[string]pulumi.StringOutput{
+		"A":    lb.Ipv4,
+		"AAAA": lb.Ipv6,
+	}
+}
+
+// KubeService deploys the placeholder loadbalancer service through the lke provider. The linode
+// cloud controller creates a nodebalancer for it, which the annotations tag and preserve
+func KubeService(ctx *pulumi.Context, svc KubeSvc, p *StaticLoadbalancer) (*corev1.Service, error) {
+	annotations := pulumi.StringMap{}
+	for k, v := range svc.Args.Annotations {
+		annotations[k] = pulumi.String(v)
+	}
+
+	return corev1.NewService(ctx, svc.Name, &corev1.ServiceArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name:        pulumi.String(svc.Name),
+			Namespace:   pulumi.String("default"),
+			Annotations: annotations,
+		},
+		Spec: &corev1.ServiceSpecArgs{
+			Type: pulumi.String("LoadBalancer"),
+			Ports: corev1.ServicePortArray{
+				corev1.ServicePortArgs{Name: pulumi.String("http"), Port: pulumi.Int(80), Protocol: pulumi.String("TCP")},
+				corev1.ServicePortArgs{Name: pulumi.String("https"), Port: pulumi.Int(443), Protocol: pulumi.String("TCP")},
+			},
+		},
+	}, pulumi.Provider(svc.Args.KubeProvider), pulumi.Parent(p), afterReady(svc.Args.Ready))
+}
+
+// NewStorageClass deploys a default block storage class, and the csi driver tags the volumes
+// it provisions. With several default classes, kubernetes picks the newest one, so this one
+// takes over from the linode-block-storage-retain class of lke
+func NewStorageClass(ctx *pulumi.Context, name string, args *StorageClassArgs, opts ...pulumi.ResourceOption) (*storagev1.StorageClass, error) {
+	opts = append(opts, pulumi.Provider(args.KubeProvider), afterReady(args.Ready))
+
+	return storagev1.NewStorageClass(ctx, name, &storagev1.StorageClassArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String("apl-block-storage"),
+			Annotations: pulumi.StringMap{
+				"storageclass.kubernetes.io/is-default-class": pulumi.String("true"),
+			},
+		},
+		Provisioner:          pulumi.String("linodebs.csi.linode.com"),
+		ReclaimPolicy:        pulumi.String("Delete"),
+		AllowVolumeExpansion: pulumi.Bool(true),
+		Parameters: pulumi.StringMap{
+			"linodebs.csi.linode.com/volumeTags": pulumi.String(strings.Join(args.Tags, ",")),
+		},
+	}, opts...)
+}
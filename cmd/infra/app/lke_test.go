@@ -0,0 +1,102 @@
+package app
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// nodebalancerMocks registers resources in memory, and answers the nodebalancer lookups with
+// the nodebalancers it has
+type nodebalancerMocks struct {
+	mu            sync.Mutex
+	types         []string
+	nodebalancers []map[string]any
+}
+
+func (m *nodebalancerMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	m.types = append(m.types, args.TypeToken)
+	m.mu.Unlock()
+	return args.Name + "-id", args.Inputs, nil
+}
+
+func (m *nodebalancerMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	if args.Token != "linode:index/getNodebalancers:getNodebalancers" {
+		return resource.PropertyMap{}, nil
+	}
+	var nbs []any
+	for _, nb := range m.nodebalancers {
+		nbs = append(nbs, nb)
+	}
+	return resource.NewPropertyMapFromMap(map[string]any{"nodebalancers": nbs}), nil
+}
+
+func (m *nodebalancerMocks) registered(typ string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Contains(m.types, typ)
+}
+
+// runStaticLoadbalancer runs a preview of the discovered static loadbalancer, with the config
+// of the infra project
+func runStaticLoadbalancer(t *testing.T, mocks *nodebalancerMocks, config string) error {
+	t.Setenv("PULUMI_CONFIG", config)
+	t.Setenv("PULUMI_DRY_RUN", "true")
+
+	return pulumi.RunErr(func(ctx *pulumi.Context) error {
+		kube, err := kubernetes.NewProvider(ctx, "lkeProvider", &kubernetes.ProviderArgs{})
+		if err != nil {
+			return err
+		}
+		_, err = NewStaticLoadbalancer(ctx, "staticLoadbalancer", &StaticLoadbalancerArgs{
+			KubeProvider:  kube,
+			Label:         "apl-demo",
+			Ready:         pulumi.Bool(true),
+			Region:        "us-ord",
+			Tags:          []string{NodeBalancerTag, PlatformTag("apl-demo")},
+			LookupTimeout: 50 * time.Millisecond,
+			LookupBackoff: 10 * time.Millisecond,
+		})
+		return err
+	}, pulumi.WithMocks("infra", "apl-demo", mocks))
+}
+
+var demoNodeBalancer = map[string]any{
+	"id": 7, "label": "ccm-apl-demo", "ipv4": "192.0.2.7", "ipv6": "2001:db8::7",
+	"region": "us-ord", "tags": []any{NodeBalancerTag, "apl-platform-apl-demo"},
+}
+
+func TestDiscoveredNodeBalancerPlaceholder(t *testing.T) {
+	mocks := &nodebalancerMocks{nodebalancers: []map[string]any{demoNodeBalancer}}
+	if err := runStaticLoadbalancer(t, mocks, `{}`); err != nil {
+		t.Fatal(err)
+	}
+	if !mocks.registered("kubernetes:core/v1:Service") {
+		t.Fatal("no placeholder service without nodebalancer-id, want one for the cloud controller")
+	}
+}
+
+func TestDiscoveredNodeBalancerHandoff(t *testing.T) {
+	mocks := &nodebalancerMocks{nodebalancers: []map[string]any{demoNodeBalancer}}
+	if err := runStaticLoadbalancer(t, mocks, `{"infra:nodebalancer-id": "7"}`); err != nil {
+		t.Fatal(err)
+	}
+	if mocks.registered("kubernetes:core/v1:Service") {
+		t.Fatal("a placeholder service with nodebalancer-id, want the ingress to be the only one")
+	}
+}
+
+func TestDiscoveredNodeBalancerGone(t *testing.T) {
+	mocks := &nodebalancerMocks{}
+	err := runStaticLoadbalancer(t, mocks, `{"infra:nodebalancer-id": "7"}`)
+	if !errors.Is(err, ErrNodeBalancerNotFound) {
+		t.Fatalf("got %v, want the preview to fail with %v", err, ErrNodeBalancerNotFound)
+	}
+}
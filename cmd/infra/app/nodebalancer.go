@@ -1,91 +1,229 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	utils "github.com/rylabs-billy/steal-this-idp/utils"
-
 	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
+// NodeBalancer is the result of a lookup
 type NodeBalancer struct {
-	id         int
-	ipv4, ipv6 string
+	Id         int
+	Label      string
+	Ipv4, Ipv6 string
+}
+
+// NodeBalancerLookup finds one nodebalancer in a region with all of the tags. Id, Label or
+// Ipv4, when set, choose among several matches
+type NodeBalancerLookup struct {
+	Region string
+	Tags   []string
+	Id     int
+	Label  string
+	Ipv4   string
+
+	// Provider is the provider of the invoke, or the default provider when nil
+	Provider *linode.Provider
+
+	// Timeout is how long a missing nodebalancer is looked for, with a Backoff that doubles
+	// up to maxNodeBalancerBackoff between attempts
+	Timeout time.Duration
+	Backoff time.Duration
+}
+
+const maxNodeBalancerBackoff = 30 * time.Second
+
+var (
+	ErrNodeBalancerNotFound  = errors.New("nodebalancer not found")
+	ErrNodeBalancerAmbiguous = errors.New("more than one nodebalancer matches")
+	ErrNodeBalancerApi       = errors.New("nodebalancer lookup failed")
+)
+
+func (l *NodeBalancerLookup) SetDefaults() {
+	if l.Timeout == 0 {
+		l.Timeout = 2 * time.Minute
+	}
+	if l.Backoff == 0 {
+		l.Backoff = 2 * time.Second
+	}
 }
 
-type GetNodeBalancerInfo struct {
-	InvkOpt     pulumi.ResourceOrInvokeOption
-	Region, Tag string
+func (l NodeBalancerLookup) String() string {
+	s := "region " + l.Region
+	if len(l.Tags) > 0 {
+		s += ", tags " + strings.Join(l.Tags, ",")
+	}
+	if l.Id != 0 {
+		s += ", id " + strconv.Itoa(l.Id)
+	}
+	if l.Label != "" {
+		s += ", label " + l.Label
+	}
+	if l.Ipv4 != "" {
+		s += ", ipv4 " + l.Ipv4
+	}
+
+	return s
 }
 
-func GetNodeBalancer(ctx *pulumi.Context, region, tag string, opt ...interface{}) NodeBalancer {
-	var (
-		nb      NodeBalancer
-		invkOpt pulumi.ResourceOrInvokeOption
-	)
-	if len(opt) > 1 {
-		i := opt[0]
-		switch v := i.(type) {
-		case *linode.Provider:
-			invkOpt = pulumi.Provider(v)
+// GetNodeBalancer looks up the nodebalancer until it is found or the timeout passes. Errors
+// wrap ErrNodeBalancerNotFound, ErrNodeBalancerAmbiguous or ErrNodeBalancerApi
+func GetNodeBalancer(ctx *pulumi.Context, l NodeBalancerLookup) (NodeBalancer, error) {
+	l.SetDefaults()
+	wctx, cancel := context.WithTimeout(ctx.Context(), l.Timeout)
+	defer cancel()
+
+	backoff := l.Backoff
+	for {
+		res, err := searchNodeBalancer(ctx, l)
+		if err != nil {
+			return NodeBalancer{}, fmt.Errorf("%w, %s: %w", ErrNodeBalancerApi, l, err)
+		}
+
+		var matches []NodeBalancer
+		for _, nb := range res.Nodebalancers {
+			if l.Id != 0 && nb.Id != l.Id {
+				continue
+			}
+			if l.Label != "" && nb.Label != l.Label {
+				continue
+			}
+			if l.Ipv4 != "" && nb.Ipv4 != l.Ipv4 {
+				continue
+			}
+			matches = append(matches, NodeBalancer{Id: nb.Id, Label: nb.Label, Ipv4: nb.Ipv4, Ipv6: nb.Ipv6})
+		}
+
+		switch len(matches) {
+		case 0:
+		case 1:
+			return matches[0], nil
 		default:
-			invkOpt = nil
+			var labels []string
+			for _, m := range matches {
+				labels = append(labels, fmt.Sprintf("%s (%d)", m.Label, m.Id))
+			}
+			return NodeBalancer{}, fmt.Errorf("%w, %s: %s", ErrNodeBalancerAmbiguous, l, strings.Join(labels, ", "))
 		}
-	}
 
-	nbinfo := &GetNodeBalancerInfo{
-		InvkOpt: invkOpt,
-		Region:  region,
-		Tag:     tag,
+		select {
+		case <-wctx.Done():
+			return NodeBalancer{}, fmt.Errorf("%w after %s, %s", ErrNodeBalancerNotFound, l.Timeout, l)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxNodeBalancerBackoff)
 	}
+}
 
-	retry := 0
-	for range 5 {
-		result := searchNodeBalancer(ctx, nbinfo)
-		if len(result.Nodebalancers) > 0 {
-			nb.id = result.Nodebalancers[0].Id
-			nb.ipv4 = result.Nodebalancers[0].Ipv4
-			nb.ipv6 = result.Nodebalancers[0].Ipv6
-			break
+// ParseLookupTiming reads the timeout and backoff of the nodebalancer lookups, e.g. 5m and 5s.
+// Empty values keep the defaults of NodeBalancerLookup
+func ParseLookupTiming(timeout, backoff string) (time.Duration, time.Duration, error) {
+	var t, b time.Duration
+	for _, d := range []struct {
+		name, value string
+		to          *time.Duration
+	}{
+		{"nodebalancerLookupTimeout", timeout, &t},
+		{"nodebalancerLookupBackoff", backoff, &b},
+	} {
+		if d.value == "" {
+			continue
 		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("apl:%s %q is not a positive duration, e.g. 2m", d.name, d.value)
+		}
+		*d.to = v
+	}
 
-		time.Sleep(5 * time.Second)
-		retry++
+	return t, b, nil
+}
+
+// NodeBalancerConfig is the apl:nodebalancer config, e.g.
+// {"managed": true, "label": "apl-demo-nb", "throttle": 20, "tags": ["team-a"]}
+type NodeBalancerConfig struct {
+	Managed  bool     `json:"managed"`
+	Label    string   `json:"label"`
+	Throttle *int     `json:"throttle"`
+	Tags     []string `json:"tags"`
+}
+
+var nbLabelRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,32}$`)
+
+// ParseNodeBalancer reads the apl:nodebalancer config. Unless managed is set, the cloud
+// controller creates the nodebalancer, and the infra stack discovers it by tag
+func ParseNodeBalancer(s, label string) (NodeBalancerConfig, error) {
+	var cfg NodeBalancerConfig
+	if s == "" {
+		return cfg, nil
+	}
+	if err := json.Unmarshal([]byte(s), &cfg); err != nil {
+		return cfg, fmt.Errorf("apl:nodebalancer is not an object with managed, label, throttle and tags: %w", err)
+	}
+	if !cfg.Managed {
+		return cfg, nil
+	}
+
+	if cfg.Label == "" {
+		cfg.Label = fmt.Sprintf("%s-nb", label)
+	}
+	if !nbLabelRe.MatchString(cfg.Label) {
+		return cfg, fmt.Errorf("apl:nodebalancer: label %q must be 3 to 32 letters, digits, - or _", cfg.Label)
+	}
+
+	// 20 is the default of the cloud controller, 0 disables the throttle
+	if cfg.Throttle == nil {
+		throttle := 20
+		cfg.Throttle = &throttle
+	}
+	if *cfg.Throttle < 0 || *cfg.Throttle > 20 {
+		return cfg, fmt.Errorf("apl:nodebalancer: throttle %d is not between 0 and 20", *cfg.Throttle)
 	}
 
-	if retry >= 5 && !utils.AssertResource(nb) {
-		return NodeBalancer{}
+	// the tags are how drift detection and sweep find the nodebalancer of this platform
+	for _, t := range []string{PlatformTag(label), NodeBalancerTag} {
+		if !slices.Contains(cfg.Tags, t) {
+			cfg.Tags = append([]string{t}, cfg.Tags...)
+		}
 	}
 
-	return nb
+	return cfg, nil
 }
 
-func searchNodeBalancer(ctx *pulumi.Context, i *GetNodeBalancerInfo) *linode.GetNodebalancersResult {
+// searchNodeBalancer lists the nodebalancers of the region that have every tag
+func searchNodeBalancer(ctx *pulumi.Context, l NodeBalancerLookup) (*linode.GetNodebalancersResult, error) {
 	matchMethod := "exact"
-	res, err := linode.GetNodebalancers(ctx, &linode.GetNodebalancersArgs{
-		Filters: []linode.GetNodebalancersFilter{
-			{
-				Name: "region",
-				Values: []string{
-					i.Region,
-				},
-				MatchBy: &matchMethod,
-			},
-			{
-				Name: "tags",
-				Values: []string{
-					i.Tag,
-					"kubernetes",
-				},
-				MatchBy: &matchMethod,
-			},
+	filters := []linode.GetNodebalancersFilter{
+		{
+			Name:    "region",
+			Values:  []string{l.Region},
+			MatchBy: &matchMethod,
 		},
-	}, i.InvkOpt)
+	}
+	// values of one filter match any, separate filters match all
+	for _, t := range l.Tags {
+		filters = append(filters, linode.GetNodebalancersFilter{
+			Name:    "tags",
+			Values:  []string{t},
+			MatchBy: &matchMethod,
+		})
+	}
 
-	if err != nil {
-		return nil
+	var opts []pulumi.InvokeOption
+	if l.Provider != nil {
+		opts = append(opts, pulumi.Provider(l.Provider))
 	}
 
-	return res
+	return linode.GetNodebalancers(ctx, &linode.GetNodebalancersArgs{
+		Filters: filters,
+	}, opts...)
 }
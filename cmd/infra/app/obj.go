@@ -1,10 +1,32 @@
 package app
 
 import (
+	"fmt"
+
 	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
+var objBuckets = []string{
+	"loki",
+	"cnpg",
+	"velero",
+	"harbor",
+	"thanos",
+	"tempo",
+	"gitea",
+}
+
+// BucketLabels are the bucket labels, and logical names, that build provisions
+func BucketLabels() []string {
+	labels := make([]string, 0, len(objBuckets))
+	for _, bucket := range objBuckets {
+		labels = append(labels, fmt.Sprintf("%s-%s", objPrefix, bucket))
+	}
+
+	return labels
+}
+
 func defaultLifecyclePolicy() linode.ObjectStorageBucketLifecycleRuleArray {
 	lifecyclePolicy := linode.ObjectStorageBucketLifecycleRuleArray{
 		&linode.ObjectStorageBucketLifecycleRuleArgs{
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// taintEffects are the effects kubernetes accepts for a node taint
+var taintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
+}
+
+// ParseNodePools reads the apl:nodePools config, a list of pools such as
+// [{"name": "system", "type": "g6-dedicated-4", "count": 3, "min": 3, "max": 5, "taints": [...]}]
+func ParseNodePools(s string) ([]NodePool, error) {
+	var pools []NodePool
+	if err := json.Unmarshal([]byte(s), &pools); err != nil {
+		return nil, fmt.Errorf("apl:nodePools is not a list of node pools: %w", err)
+	}
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("apl:nodePools has no node pools")
+	}
+
+	var names []string
+	for i, np := range pools {
+		if np.Name == "" {
+			return nil, fmt.Errorf("apl:nodePools: node pool %d has no name", i)
+		}
+		if slices.Contains(names, np.Name) {
+			return nil, fmt.Errorf("apl:nodePools: node pool %s is defined twice", np.Name)
+		}
+		names = append(names, np.Name)
+		if err := np.valid(); err != nil {
+			return nil, fmt.Errorf("apl:nodePools: node pool %s: %w", np.Name, err)
+		}
+	}
+
+	return pools, nil
+}
+
+func (np NodePool) valid() error {
+	if np.Type == "" {
+		return fmt.Errorf("type is not set")
+	}
+	if np.Count < 0 || np.Min < 0 || np.Max < 0 {
+		return fmt.Errorf("count, min and max cannot be negative")
+	}
+	if np.Max > 0 {
+		if np.Min > np.Max {
+			return fmt.Errorf("autoscaler min %d is more than max %d", np.Min, np.Max)
+		}
+		if np.Count > 0 && (np.Count < np.Min || np.Count > np.Max) {
+			return fmt.Errorf("count %d is not between autoscaler min %d and max %d", np.Count, np.Min, np.Max)
+		}
+	}
+	for _, t := range np.Taints {
+		if t.Key == "" {
+			return fmt.Errorf("taint has no key")
+		}
+		if !slices.Contains(taintEffects, t.Effect) {
+			return fmt.Errorf("taint %s has effect %q, expected one of %s", t.Key, t.Effect, strings.Join(taintEffects, ", "))
+		}
+	}
+
+	return nil
+}
+
+// validNodePoolTypes fails the preview when a pool has a type that linode doesn't offer
+func validNodePoolTypes(ctx *pulumi.Context, pools []NodePool, provider *linode.Provider) error {
+	res, err := linode.GetInstanceTypes(ctx, &linode.GetInstanceTypesArgs{}, pulumi.Provider(provider))
+	if err != nil {
+		return fmt.Errorf("failed to list linode types: %w", err)
+	}
+
+	types := make([]string, 0, len(res.Types))
+	for _, t := range res.Types {
+		types = append(types, t.Id)
+	}
+	for _, np := range pools {
+		if !slices.Contains(types, np.Type) {
+			return fmt.Errorf("node pool %s has unknown linode type %q", np.Name, np.Type)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package app
+
+import "testing"
+
+func TestPlannedPoolsDefaults(t *testing.T) {
+	tests := []struct {
+		name            string
+		nodePools       string
+		count, min, max int
+	}{
+		{"default pool", "", 3, 3, 15},
+		{"max below the default count", `[{"name": "small", "type": "g6-standard-2", "max": 2}]`, 2, 2, 2},
+		{"min without count", `[{"name": "ranged", "type": "g6-standard-2", "min": 1, "max": 5}]`, 1, 1, 5},
+		{"count without min", `[{"name": "counted", "type": "g6-standard-2", "count": 4, "max": 6}]`, 4, 4, 6},
+		{"fixed size", `[{"name": "fixed", "type": "g6-standard-2", "count": 2}]`, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		pools, err := PlannedPools(map[string]string{"label": "apl-demo", "nodePools": tt.nodePools})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		np := pools[0]
+		if np.Count != tt.count || np.Min != tt.min || np.Max != tt.max {
+			t.Errorf("%s: got count %d, min %d and max %d, want %d, %d and %d", tt.name, np.Count, np.Min, np.Max, tt.count, tt.min, tt.max)
+		}
+		if err := np.valid(); err != nil {
+			t.Errorf("%s: the pool with defaults is invalid: %v", tt.name, err)
+		}
+	}
+}
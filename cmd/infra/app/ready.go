@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"gopkg.in/yaml.v2"
+)
+
+const lkeReadyPoll = 10 * time.Second
+
+type WaitForLke struct {
+	pulumi.ResourceState
+
+	Ready pulumi.BoolOutput `pulumi:"lkeReady"`
+}
+
+type WaitForLkeArgs struct {
+	Cluster  *linode.LkeCluster
+	Provider *linode.Provider
+	Timeout  time.Duration
+}
+
+// kubeconfig is the part of an lke kubeconfig that the readiness check reads
+type kubeconfig struct {
+	Clusters []struct {
+		Cluster struct {
+			Server string `yaml:"server"`
+			CaData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		User struct {
+			Token string `yaml:"token"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// NewWaitForLke waits until the cluster and every pool node are ready in the linode api, and
+// every node reports Ready in the kubernetes api. Resources that need a working cluster use
+// Ready as an input, or depend on the component
+func NewWaitForLke(ctx *pulumi.Context, name string, args *WaitForLkeArgs, opts ...pulumi.ResourceOption) (*WaitForLke, error) {
+	var lkeResource WaitForLke
+
+	err := ctx.RegisterComponentResource("pkg:index:WaitForLke", name, &lkeResource, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Timeout == 0 {
+		args.Timeout = 20 * time.Minute
+	}
+
+	ready := pulumi.All(args.Cluster.ID(), args.Cluster.Kubeconfig).ApplyT(func(v []interface{}) (bool, error) {
+		id, err := strconv.Atoi(string(v[0].(pulumi.ID)))
+		if err != nil {
+			return false, fmt.Errorf("invalid lke cluster id %q: %w", v[0], err)
+		}
+
+		wctx, cancel := context.WithTimeout(ctx.Context(), args.Timeout)
+		defer cancel()
+
+		nodes, err := waitLkeNodes(wctx, ctx, id, args.Provider)
+		if err != nil {
+			return false, err
+		}
+		if err := waitKubeNodes(wctx, v[1].(string), nodes); err != nil {
+			return false, err
+		}
+		ctx.Log.Info(fmt.Sprintf("lke cluster %d and its %d nodes are ready", id, nodes), &pulumi.LogArgs{Resource: &lkeResource})
+
+		return true, nil
+	}).(pulumi.BoolOutput)
+
+	lkeResource.Ready = ready
+	ctx.RegisterResourceOutputs(&lkeResource, pulumi.Map{
+		"lkeReady": ready,
+	})
+
+	return &lkeResource, nil
+}
+
+// afterReady makes a resource wait until ready resolves, without making it an input that
+// would replace the resource when it changes
+func afterReady(ready pulumi.BoolInput) pulumi.ResourceOption {
+	if ready == nil {
+		return pulumi.DependsOn(nil)
+	}
+	deps := ready.ToBoolOutput().ApplyT(func(bool) []pulumi.Resource {
+		return nil
+	}).(pulumi.ResourceArrayOutput)
+
+	return pulumi.DependsOnInputs(deps)
+}
+
+// waitLkeNodes polls the cluster and its pool nodes, and returns the number of nodes
+func waitLkeNodes(wctx context.Context, ctx *pulumi.Context, id int, provider *linode.Provider) (int, error) {
+	for {
+		res, err := linode.LookupLkeCluster(ctx, &linode.LookupLkeClusterArgs{Id: id}, pulumi.Provider(provider))
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up lke cluster %d: %w", id, err)
+		}
+
+		nodes, pending := 0, 0
+		for _, p := range res.Pools {
+			for _, n := range p.Nodes {
+				nodes++
+				if n.Status != "ready" {
+					pending++
+				}
+			}
+		}
+		if res.Status == "ready" && nodes > 0 && pending == 0 {
+			return nodes, nil
+		}
+
+		select {
+		case <-wctx.Done():
+			return 0, fmt.Errorf("timed out waiting for lke cluster %d, status %s with %d of %d nodes not ready", id, res.Status, pending, nodes)
+		case <-time.After(lkeReadyPoll):
+		}
+	}
+}
+
+// waitKubeNodes polls the kubernetes api until the nodes have registered and report Ready
+func waitKubeNodes(wctx context.Context, enc string, want int) error {
+	client, server, token, err := kubeClient(enc)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ready, total, err := readyNodes(wctx, client, server, token)
+		if err == nil && total >= want && ready == total {
+			return nil
+		}
+
+		select {
+		case <-wctx.Done():
+			if err != nil {
+				return fmt.Errorf("timed out waiting for kubernetes nodes: %w", err)
+			}
+			return fmt.Errorf("timed out waiting for kubernetes nodes, %d of %d ready, %d expected", ready, total, want)
+		case <-time.After(lkeReadyPoll):
+		}
+	}
+}
+
+// kubeClient builds an http client for the api server of a base64 encoded lke kubeconfig
+func kubeClient(enc string) (*http.Client, string, string, error) {
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error decoding kubeconfig: %w", err)
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, "", "", fmt.Errorf("error with yaml unmarshal: %w", err)
+	}
+	if len(cfg.Clusters) == 0 || len(cfg.Users) == 0 {
+		return nil, "", "", fmt.Errorf("kubeconfig has no cluster or user")
+	}
+
+	ca, err := base64.StdEncoding.DecodeString(cfg.Clusters[0].Cluster.CaData)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error decoding the kubeconfig ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	return client, cfg.Clusters[0].Cluster.Server, cfg.Users[0].User.Token, nil
+}
+
+func readyNodes(ctx context.Context, client *http.Client, server, token string) (int, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"/api/v1/nodes", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("kubernetes api: %s", res.Status)
+	}
+
+	var nodes struct {
+		Items []struct {
+			Status struct {
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&nodes); err != nil {
+		return 0, 0, err
+	}
+
+	ready := 0
+	for _, n := range nodes.Items {
+		for _, c := range n.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				ready++
+			}
+		}
+	}
+
+	return ready, len(nodes.Items), nil
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+
+	"github.com/pulumi/pulumi-linode/sdk/v4/go/linode"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// VpcConfig is the apl:vpc config, e.g.
+// {"enabled": true, "subnets": [{"label": "nodes", "ipv4": "10.0.0.0/24"}]}
+type VpcConfig struct {
+	Enabled bool        `json:"enabled"`
+	Label   string      `json:"label"`
+	Subnets []VpcSubnet `json:"subnets"`
+}
+
+type VpcSubnet struct {
+	Label string `json:"label"`
+	Ipv4  string `json:"ipv4"`
+}
+
+type Vpc struct {
+	pulumi.ResourceState
+
+	Id      pulumi.IDOutput  `pulumi:"vpcId"`
+	Subnets pulumi.MapOutput `pulumi:"vpcSubnets"`
+}
+
+type VpcArgs struct {
+	Config VpcConfig
+	Region string
+}
+
+// privateRanges are the ranges linode allows for vpc subnets, but the lke node network
+var privateRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// ParseVpc reads the apl:vpc config, the vpc is disabled unless enabled is set
+func ParseVpc(s, label string) (VpcConfig, error) {
+	var cfg VpcConfig
+	if s == "" {
+		return cfg, nil
+	}
+	if err := json.Unmarshal([]byte(s), &cfg); err != nil {
+		return cfg, fmt.Errorf("apl:vpc is not an object with a label and subnets: %w", err)
+	}
+	if !cfg.Enabled {
+		return cfg, nil
+	}
+
+	if cfg.Label == "" {
+		cfg.Label = fmt.Sprintf("%s-vpc", label)
+	}
+	if len(cfg.Subnets) == 0 {
+		cfg.Subnets = []VpcSubnet{{Label: "nodes", Ipv4: "10.0.0.0/24"}}
+	}
+
+	var (
+		labels []string
+		nets   []*net.IPNet
+	)
+	_, lkeNet, _ := net.ParseCIDR(lkePrivateRange)
+	for i, sn := range cfg.Subnets {
+		if sn.Label == "" {
+			return cfg, fmt.Errorf("apl:vpc: subnet %d has no label", i)
+		}
+		if slices.Contains(labels, sn.Label) {
+			return cfg, fmt.Errorf("apl:vpc: subnet %s is defined twice", sn.Label)
+		}
+		labels = append(labels, sn.Label)
+
+		ip, ipnet, err := net.ParseCIDR(sn.Ipv4)
+		if err != nil || ip.To4() == nil {
+			return cfg, fmt.Errorf("apl:vpc: subnet %s has %q, expected an ipv4 cidr", sn.Label, sn.Ipv4)
+		}
+		if !privateCidr(ipnet) || overlaps(ipnet, lkeNet) {
+			return cfg, fmt.Errorf("apl:vpc: subnet %s %s is not in %v, or overlaps the lke range %s", sn.Label, sn.Ipv4, privateRanges, lkePrivateRange)
+		}
+		for j, n := range nets {
+			if overlaps(ipnet, n) {
+				return cfg, fmt.Errorf("apl:vpc: subnet %s overlaps subnet %s", sn.Label, cfg.Subnets[j].Label)
+			}
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return cfg, nil
+}
+
+func privateCidr(n *net.IPNet) bool {
+	size, _ := n.Mask.Size()
+	for _, r := range privateRanges {
+		_, p, _ := net.ParseCIDR(r)
+		psize, _ := p.Mask.Size()
+		if p.Contains(n.IP) && size >= psize {
+			return true
+		}
+	}
+
+	return false
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// NewVpc creates a vpc with its subnets in the region, and exports their ids and cidrs
+func NewVpc(ctx *pulumi.Context, name string, args *VpcArgs, opts ...pulumi.ResourceOption) (*Vpc, error) {
+	var vpcResource Vpc
+
+	err := ctx.RegisterComponentResource("pkg:index:Vpc", name, &vpcResource, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	vpc, err := linode.NewVpc(ctx, args.Config.Label, &linode.VpcArgs{
+		Label:       pulumi.String(args.Config.Label),
+		Region:      pulumi.String(args.Region),
+		Description: pulumi.String("app platform vpc"),
+	}, pulumi.Parent(&vpcResource))
+	if err != nil {
+		return nil, err
+	}
+
+	vpcId := vpc.ID().ApplyT(func(i pulumi.ID) int {
+		id, _ := strconv.Atoi(string(i))
+		return id
+	}).(pulumi.IntOutput)
+
+	subnets := pulumi.Map{}
+	for _, sn := range args.Config.Subnets {
+		subnet, err := linode.NewVpcSubnet(ctx, fmt.Sprintf("%s-%s", args.Config.Label, sn.Label), &linode.VpcSubnetArgs{
+			VpcId: vpcId,
+			Label: pulumi.String(sn.Label),
+			Ipv4:  pulumi.String(sn.Ipv4),
+		}, pulumi.Parent(&vpcResource))
+		if err != nil {
+			return nil, err
+		}
+		subnets[sn.Label] = pulumi.Map{
+			"id":   subnet.ID(),
+			"ipv4": subnet.Ipv4,
+		}
+	}
+
+	vpcResource.Id = vpc.ID()
+	vpcResource.Subnets = subnets.ToMapOutput()
+
+	ctx.RegisterResourceOutputs(&vpcResource, pulumi.Map{
+		"vpcId":      vpc.ID(),
+		"vpcSubnets": subnets,
+	})
+
+	return &vpcResource, nil
+}
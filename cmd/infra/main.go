@@ -16,6 +16,21 @@ func main() {
 			"label":  aplcfg.Require("label"),
 			"email":  aplcfg.Require("email"),
 			"region": aplcfg.Require("region"),
+			// optional node pools, a list of objects read as json
+			"nodePools": aplcfg.Get("nodePools"),
+			// optional control plane acl, an object read as json
+			"controlPlaneAcl": aplcfg.Get("controlPlaneAcl"),
+			// optional extra inbound firewall rules, a list of objects read as json
+			"firewallRules": aplcfg.Get("firewallRules"),
+			// optional vpc, an object read as json
+			"vpc": aplcfg.Get("vpc"),
+			// optional kubernetes version, defaults to the version the apl chart is tested with
+			"k8sVersion": aplcfg.Get("k8sVersion"),
+			// optional nodebalancer owned by the stack, an object read as json
+			"nodebalancer": aplcfg.Get("nodebalancer"),
+			// optional timeout and backoff of the nodebalancer lookups, durations like 5m
+			"nodebalancerLookupTimeout": aplcfg.Get("nodebalancerLookupTimeout"),
+			"nodebalancerLookupBackoff": aplcfg.Get("nodebalancerLookupBackoff"),
 		}
 		resources := make(map[string]interface{})
 
@@ -23,6 +38,9 @@ func main() {
 			Data:      cfgData,
 			Resources: resources,
 			Token:     cfg.Require("token"),
+			// optional, the linode api url and version
+			ApiUrl:     cfg.Get("url"),
+			ApiVersion: cfg.Get("apiVersion"),
 		}
 		err := infra.Build(ctx)
 		if err != nil {